@@ -0,0 +1,36 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dk13danger/media-service/config"
+)
+
+const (
+	DRIVER_LOCAL = "local"
+	DRIVER_S3    = "s3"
+)
+
+// BlobStore keeps processed media files by keys.
+type BlobStore interface {
+	// Put moves local file into the store by the key and returns location of the stored object.
+	Put(ctx context.Context, key, filePath string) (string, error)
+	// Delete removes object by the key, missing object isn't an error.
+	Delete(ctx context.Context, key string) error
+	// Key returns key of the object by its location returned by Put.
+	// Error is returned if location isn't in the store.
+	Key(location string) (string, error)
+}
+
+// New creates blob store by configured driver.
+// Panics if driver is not supported or config is invalid.
+func New(cfg *config.BlobStore) BlobStore {
+	switch cfg.Driver {
+	case DRIVER_LOCAL, "":
+		return NewLocalStore(cfg.Dir)
+	case DRIVER_S3:
+		return NewS3Store(&cfg.S3)
+	}
+	panic(fmt.Sprintf("Blob store driver %q is not supported", cfg.Driver))
+}
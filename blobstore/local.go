@@ -0,0 +1,109 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStore keeps files in the local directory.
+type localStore struct {
+	dir string
+}
+
+// NewLocalStore creates store in the directory, directory is created if it doesn't exist.
+// Panics if directory can't be created.
+func NewLocalStore(dir string) BlobStore {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid blob store dir %q: %v", dir, err))
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		panic(fmt.Sprintf("Error while creating blob store dir %q: %v", abs, err))
+	}
+	return &localStore{dir: abs}
+}
+
+// path returns path of the object, error is returned if key points outside of the store dir.
+func (s *localStore) path(key string) (string, error) {
+	path := filepath.Join(s.dir, key)
+	if !strings.HasPrefix(path, s.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %q escapes blob store dir %q", key, s.dir)
+	}
+	return path, nil
+}
+
+// Put renames file into the store dir, file from other device is copied to the temp file and renamed.
+func (s *localStore) Put(ctx context.Context, key, filePath string) (string, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filePath, path); err != nil {
+		if err := copyFile(filePath, path+".tmp"); err != nil {
+			return "", err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			os.Remove(path + ".tmp")
+			return "", err
+		}
+		os.Remove(filePath)
+	}
+	location := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return location.String(), nil
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStore) Key(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("location %q is not in blob store dir %q", location, s.dir)
+	}
+	key, err := filepath.Rel(s.dir, filepath.FromSlash(u.Path))
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(key), nil
+}
+
+func copyFile(src, dst string) error {
+	input, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		os.Remove(dst)
+		return err
+	}
+	return output.Close()
+}
@@ -0,0 +1,72 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewLocalStore(filepath.Join(dir, "store"))
+	ctx := context.Background()
+
+	filePath := tempFile(t, "hello")
+	defer os.Remove(filePath)
+	location, err := s.Put(ctx, "md5/hash-1", filePath)
+	if err != nil {
+		t.Fatalf("Put(): %v", err)
+	}
+	path := filepath.Join(dir, "store", "md5", "hash-1")
+	if want := "file://" + filepath.ToSlash(path); location != want {
+		t.Fatalf("Put() = %q; want %q", location, want)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "hello" {
+		t.Fatalf("stored file = %q, %v; want uploaded content", content, err)
+	}
+	if key, err := s.Key(location); err != nil || key != "md5/hash-1" {
+		t.Fatalf("Key(%q) = %q, %v; want md5/hash-1", location, key, err)
+	}
+	for _, location := range []string{"file://" + filepath.ToSlash(dir) + "/x", "s3://store/md5/hash-1", location + "/../../../../x"} {
+		if key, err := s.Key(location); err == nil {
+			t.Errorf("Key(%q) = %q; want error", location, key)
+		}
+	}
+
+	if err := s.Delete(ctx, "md5/hash-1"); err != nil {
+		t.Fatalf("Delete(): %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("deleted file is left: %v", err)
+	}
+	if err := s.Delete(ctx, "md5/hash-1"); err != nil {
+		t.Fatalf("Delete() of missing file: %v", err)
+	}
+}
+
+func TestLocalStoreKeyEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewLocalStore(dir)
+	ctx := context.Background()
+
+	filePath := tempFile(t, "hello")
+	defer os.Remove(filePath)
+	for _, key := range []string{"../x", "a/../../x", "", "."} {
+		if _, err := s.Put(ctx, key, filePath); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if err := s.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+	}
+}
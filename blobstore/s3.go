@@ -0,0 +1,244 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dk13danger/media-service/config"
+)
+
+const defaultRegion = "us-east-1"
+
+// s3Store keeps files in the bucket of S3-compatible object storage. Objects are addressed by path style
+// urls (`<endpoint>/<bucket>/<key>`), so MinIO and other stand-ins work without DNS setup.
+// Requests are signed by AWS Signature Version 4, anonymous requests are sent if access key is empty.
+type s3Store struct {
+	cfg      *config.S3
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// responseError is returned when object storage responds with unexpected status.
+type responseError struct {
+	method  string
+	url     string
+	status  string
+	code    string
+	message string
+}
+
+func (e *responseError) Error() string {
+	if e.code == "" {
+		return fmt.Sprintf("%s %q: unexpected response status: %s", e.method, e.url, e.status)
+	}
+	return fmt.Sprintf("%s %q: unexpected response status: %s (%s: %s)", e.method, e.url, e.status, e.code, e.message)
+}
+
+// NewS3Store creates store in the bucket. Panics if endpoint or bucket is invalid.
+func NewS3Store(cfg *config.S3) BlobStore {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		panic(fmt.Sprintf("Invalid S3 endpoint %q: absolute http(s) url is expected", cfg.Endpoint))
+	}
+	if cfg.Bucket == "" {
+		panic("S3 bucket is not configured")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultRegion
+	}
+	return &s3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}
+}
+
+func (s *s3Store) objectUrl(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + key
+	u.RawPath = escape(u.Path, false)
+	return &u
+}
+
+// Put uploads file by one request (objects are limited by 5 GB) and removes it.
+func (s *s3Store) Put(ctx context.Context, key, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// Payload hash is signed, so file is read twice.
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequest(http.MethodPut, s.objectUrl(key).String(), file)
+	if err != nil {
+		return "", err
+	}
+	request.ContentLength = size
+	if err := s.do(ctx, request, hex.EncodeToString(hasher.Sum(nil))); err != nil {
+		return "", err
+	}
+
+	file.Close()
+	os.Remove(filePath)
+	return s.location(key), nil
+}
+
+func (s *s3Store) location(key string) string {
+	return fmt.Sprintf("s3://%s/%s%s", s.cfg.Bucket, s.cfg.Prefix, key)
+}
+
+func (s *s3Store) Key(location string) (string, error) {
+	prefix := s.location("")
+	if !strings.HasPrefix(location, prefix) || location == prefix {
+		return "", fmt.Errorf("location %q is not in %q", location, prefix)
+	}
+	return strings.TrimPrefix(location, prefix), nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	request, err := http.NewRequest(http.MethodDelete, s.objectUrl(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	err = s.do(ctx, request, emptyPayloadHash)
+	if e, ok := err.(*responseError); ok && e.code == "NoSuchKey" {
+		return nil
+	}
+	return err
+}
+
+// emptyPayloadHash is sha256 of the empty body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do sends signed request and returns responseError if response status isn't successful.
+func (s *s3Store) do(ctx context.Context, request *http.Request, payloadHash string) error {
+	request = request.WithContext(ctx)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.AccessKey != "" {
+		signV4(request, s.cfg.Region, s.cfg.AccessKey, s.cfg.SecretKey, time.Now())
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	ret := &responseError{method: request.Method, url: request.URL.String(), status: response.Status}
+	body := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	content, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if xml.Unmarshal(content, &body) == nil {
+		ret.code = body.Code
+		ret.message = body.Message
+	}
+	return ret
+}
+
+// signV4 signs request by AWS Signature Version 4: host and all headers set before signing are signed,
+// payload hash must be set by `X-Amz-Content-Sha256` header.
+func signV4(request *http.Request, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		request.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashHex(canonicalRequest)}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(name, true)+"="+escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// escape percent-encodes everything except unreserved characters (and slashes, unless escapeSlash is set).
+func escape(value string, escapeSlash bool) string {
+	ret := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			ret = append(ret, c)
+			continue
+		}
+		ret = append(ret, fmt.Sprintf("%%%02X", c)...)
+	}
+	return string(ret)
+}
+
+func hashHex(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,121 @@
+// Package checksum contains registry of supported hash algorithms
+// used to validate downloaded files.
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	MD5    = "md5"
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+	CRC32C = "crc32c"
+)
+
+// Algorithm describes hash function, Size is the length of the hex encoded digest.
+type Algorithm struct {
+	Name string
+	Size int
+	New  func() hash.Hash
+}
+
+var (
+	mu         sync.RWMutex
+	algorithms = make(map[string]*Algorithm)
+)
+
+func init() {
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+
+	Register(MD5, md5.Size, md5.New)
+	Register(SHA1, sha1.Size, sha1.New)
+	Register(SHA256, sha256.Size, sha256.New)
+	Register(SHA512, sha512.Size, sha512.New)
+	Register(CRC32C, crc32.Size, func() hash.Hash {
+		return crc32.New(castagnoli)
+	})
+}
+
+// Register makes hash algorithm available by name. Size is the digest size in bytes.
+func Register(name string, size int, fn func() hash.Hash) {
+	mu.Lock()
+	defer mu.Unlock()
+	algorithms[name] = &Algorithm{
+		Name: name,
+		Size: size * 2,
+		New:  fn,
+	}
+}
+
+// Get returns registered algorithm by name.
+func Get(name string) (*Algorithm, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	algo, ok := algorithms[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("checksum algorithm %q is not supported", name)
+	}
+	return algo, nil
+}
+
+// Names returns sorted names of all registered algorithms.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checksum is the hex encoded digest with algorithm used to calculate it.
+type Checksum struct {
+	Algorithm string
+	Digest    string
+}
+
+// New validates digest for given algorithm.
+func New(algorithm, digest string) (*Checksum, error) {
+	algo, err := Get(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	digest = strings.ToLower(digest)
+	if len(digest) != algo.Size {
+		return nil, fmt.Errorf("%s hash length invalid. Must be: %d", algo.Name, algo.Size)
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return nil, fmt.Errorf("%s hash must be hex encoded: %v", algo.Name, err)
+	}
+	return &Checksum{
+		Algorithm: algo.Name,
+		Digest:    digest,
+	}, nil
+}
+
+// Parse parses checksum in form of "<algorithm>:<hex digest>".
+func Parse(value string) (*Checksum, error) {
+	tokens := strings.SplitN(value, ":", 2)
+	if len(tokens) != 2 {
+		return nil, fmt.Errorf("checksum %q must be in form of <algorithm>:<hex digest>", value)
+	}
+	return New(tokens[0], tokens[1])
+}
+
+func (c *Checksum) String() string {
+	return fmt.Sprintf("%s:%s", c.Algorithm, c.Digest)
+}
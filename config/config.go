@@ -8,22 +8,123 @@ import (
 )
 
 type Config struct {
-	DbFilepath     string         `yaml:"db_filepath"`
-	Server         Server         `yaml:"server"`
-	Service        Service        `yaml:"service"`
-	CacheManager   CacheManager   `yaml:"cache_manager"`
+	// DbFilepath is deprecated: use Storage.Dsn instead.
+	DbFilepath   string       `yaml:"db_filepath"`
+	Storage      Storage      `yaml:"storage"`
+	Server       Server       `yaml:"server"`
+	Service      Service      `yaml:"service"`
+	CacheManager CacheManager `yaml:"cache_manager"`
+	Notifier     Notifier     `yaml:"notifier"`
+	BlobStore    BlobStore    `yaml:"blob_store"`
 }
 
+// Storage describes db connection. Driver is "sqlite" (by default), "postgres" or "memory",
+// Dsn is the path to db file for sqlite or connection string for postgres (ignored by memory).
+type Storage struct {
+	Driver string `yaml:"driver"`
+	Dsn    string `yaml:"dsn"`
+}
+
+// BlobStore describes where processed media files are stored. Driver is "local" (by default) or "s3".
+// Local files are stored in Dir (service output dir by default).
+type BlobStore struct {
+	Driver string `yaml:"driver"`
+	Dir    string `yaml:"dir"`
+	S3     S3     `yaml:"s3"`
+}
+
+// S3 describes bucket of S3-compatible object storage (AWS S3, MinIO, etc.) at Endpoint url,
+// Prefix is prepended to object keys. Region is "us-east-1" by default.
+type S3 struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// Server describes http server. Admin endpoints require `Authorization: Bearer <AdminToken>` header,
+// they are disabled when AdminToken is empty.
 type Server struct {
-	Port            int `yaml:"port"`
-	ShutdownTimeout int `yaml:"shutdown_timeout"`
+	Port            int    `yaml:"port"`
+	ShutdownTimeout int    `yaml:"shutdown_timeout"`
+	AdminToken      string `yaml:"admin_token"`
 }
 
+// Service describes download workers. Workers claim queued jobs for LeaseTimeout seconds (60 by default,
+// lease is extended while job is processed) and poll the queue every PollInterval seconds (5 by default).
+// New tasks are rejected while QueueCapacity jobs are waiting in the queue (zero means unlimited),
+// clients are asked to retry after RetryAfter seconds.
+// Higher priority jobs are claimed first, but waiting for PriorityAging seconds raises job by one
+// priority level, so low priority jobs make progress too (zero means strict priority without aging).
+// Failed downloads are retried by policy of the error kind ("dns", "connection", "server", "rate_limited",
+// "not_found", "rejected", "checksum", "disk_full", "other"), Attempts is used by policies which don't set their own.
+// Remote files are downloaded by http client configured by Http. Downloads from one host are limited
+// by HostLimits of the host or by HostLimit for hosts which aren't listed, all downloads together are limited by Bandwidth.
 type Service struct {
-	ChannelSize int    `yaml:"channel_size"`
-	Workers     int    `yaml:"workers"`
-	Attempts    int    `yaml:"attempts"`
-	OutputDir   string `yaml:"output_dir"`
+	Workers       int                  `yaml:"workers"`
+	Attempts      int                  `yaml:"attempts"`
+	OutputDir     string               `yaml:"output_dir"`
+	LeaseTimeout  int                  `yaml:"lease_timeout"`
+	PollInterval  int                  `yaml:"poll_interval"`
+	QueueCapacity int                  `yaml:"queue_capacity"`
+	RetryAfter    int                  `yaml:"retry_after"`
+	PriorityAging int                  `yaml:"priority_aging"`
+	Retries       map[string]Retry     `yaml:"retries"`
+	Http          HttpClient           `yaml:"http"`
+	HostLimit     HostLimit            `yaml:"host_limit"`
+	HostLimits    map[string]HostLimit `yaml:"host_limits"`
+	Bandwidth     Bandwidth            `yaml:"bandwidth"`
+}
+
+// Bandwidth limits total download speed of one service replica by Limit bytes per second
+// or by limit of the first schedule matched by current time of day. Zero means unlimited.
+type Bandwidth struct {
+	Limit     int64               `yaml:"limit" json:"limit"`
+	Schedules []BandwidthSchedule `yaml:"schedules" json:"schedules"`
+}
+
+// BandwidthSchedule sets Limit from Start till End (local time "HH:MM"), End before Start means the next day.
+type BandwidthSchedule struct {
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+	Limit int64  `yaml:"limit" json:"limit"`
+}
+
+// HostLimit limits downloads from one host by one service replica: MaxConnections concurrent downloads,
+// RequestsPerSecond started downloads and Bandwidth bytes per second shared by its downloads.
+// Zero means unlimited.
+type HostLimit struct {
+	MaxConnections    int     `yaml:"max_connections"`
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Bandwidth         int64   `yaml:"bandwidth"`
+}
+
+// HttpClient describes client which downloads remote files. Timeouts are in seconds: ConnectTimeout limits
+// dialing (and TLS handshake), HeaderTimeout limits waiting for response headers, download is aborted
+// when no bytes are received for IdleTimeout. Responses larger than MaxBodySize bytes (zero means unlimited)
+// or with content type not matched by AllowedContentTypes (e.g. "video/*", empty means any) are rejected.
+// Zero fields are replaced by defaults.
+type HttpClient struct {
+	ConnectTimeout      int      `yaml:"connect_timeout"`
+	HeaderTimeout       int      `yaml:"header_timeout"`
+	IdleTimeout         int      `yaml:"idle_timeout"`
+	MaxRedirects        int      `yaml:"max_redirects"`
+	MaxBodySize         int64    `yaml:"max_body_size"`
+	UserAgent           string   `yaml:"user_agent"`
+	AllowedContentTypes []string `yaml:"allowed_content_types"`
+}
+
+// Retry describes retry policy of one kind of download errors: task is failed after Attempts attempts,
+// delay before the next attempt doubles from Backoff up to MaxBackoff seconds and is randomized
+// by Jitter (fraction of the delay, e.g. 0.2 means +-20%). Zero fields are taken from the default policy.
+// Attempts of all kinds are counted together: Attempts limits the total count of attempts when error of the kind occurs.
+type Retry struct {
+	Attempts   int     `yaml:"attempts"`
+	Backoff    int     `yaml:"backoff"`
+	MaxBackoff int     `yaml:"max_backoff"`
+	Jitter     float64 `yaml:"jitter"`
 }
 
 type CacheManager struct {
@@ -31,6 +132,17 @@ type CacheManager struct {
 	Expiration int `yaml:"expiration"`
 }
 
+// Notifier describes webhook callbacks delivery.
+// All durations are in seconds, PollInterval is 5 seconds by default.
+type Notifier struct {
+	Secret       string `yaml:"secret"`
+	Attempts     int    `yaml:"attempts"`
+	Backoff      int    `yaml:"backoff"`
+	MaxBackoff   int    `yaml:"max_backoff"`
+	Timeout      int    `yaml:"timeout"`
+	PollInterval int    `yaml:"poll_interval"`
+}
+
 // MustInit read config file and parse it into struct.
 // Panics if any operations fail.
 func MustInit(filePath string) *Config {
@@ -42,5 +154,11 @@ func MustInit(filePath string) *Config {
 	if err := yaml.Unmarshal(content, cfg); err != nil {
 		panic(fmt.Sprintf("Error while unmarshalling configuration: %v", err))
 	}
+	if cfg.Storage.Dsn == "" {
+		cfg.Storage.Dsn = cfg.DbFilepath
+	}
+	if cfg.BlobStore.Dir == "" {
+		cfg.BlobStore.Dir = cfg.Service.OutputDir
+	}
 	return cfg
 }
@@ -4,11 +4,16 @@ SERVICE_DIR=${PWD}
 SERVICE_BINARY=media-service.o
 DEBUG_MODE=true
 URL="http://localhost:8080"
+ADMIN_TOKEN=${ADMIN_TOKEN:-}
 
 download_single() {
     curl "${URL}/dl?url=${1}&md5=${2}"
 }
 
+download_batch() {
+    curl -X POST --data-binary @- "${URL}/dl/batch"
+}
+
 get_statistic() {
     if [ -z "$1" ]; then
         curl "${URL}/st"
@@ -17,6 +22,38 @@ get_statistic() {
     fi
 }
 
+get_task() {
+    curl "${URL}/tasks/${1}"
+}
+
+cancel_task() {
+    curl -X DELETE "${URL}/tasks/${1}"
+}
+
+delete_file() {
+    curl -X DELETE "${URL}/files/${1}"
+}
+
+get_batch() {
+    curl "${URL}/batches/${1}"
+}
+
+get_queue() {
+    curl "${URL}/queue"
+}
+
+get_bandwidth() {
+    curl -H "Authorization: Bearer ${ADMIN_TOKEN}" "${URL}/admin/bandwidth"
+}
+
+set_bandwidth() {
+    curl -X PUT -H "Authorization: Bearer ${ADMIN_TOKEN}" --data-binary "{\"limit\": ${1}}" "${URL}/admin/bandwidth"
+}
+
+get_events() {
+    curl -N "${URL}/events"
+}
+
 case "$1" in
     "run")
         export DEBUG_MODE=${DEBUG_MODE}
@@ -30,12 +67,50 @@ case "$1" in
             -v ${SERVICE_DIR}/sys/media.db:/etc/media-service/media.db \
             media-service:latest
         ;;
+    "run-minio")
+        docker run -it --rm --name media-service-minio \
+            -p 9000:9000 \
+            -e MINIO_ROOT_USER=minioadmin \
+            -e MINIO_ROOT_PASSWORD=minioadmin \
+            minio/minio server /data
+        ;;
     "test-web")
         get_statistic "" ""
         ;;
     "test-web-params")
         get_statistic "http://www.sample-videos.com/video/mp4/720/big_buck_bunny_720p_1mb.mp4" "d55bddf8d62910879ed9f605522149a8"
         ;;
+    "test-batch")
+        download_batch <<EOF
+{"url": "http://www.sample-videos.com/video/mp4/720/big_buck_bunny_720p_1mb.mp4", "md5": "d55bddf8d62910879ed9f605522149a8"}
+{"url": "http://www.sample-videos.com/video/mp4/720/big_buck_bunny_720p_3mb.mp4", "md5": "c689c2d468f841a20116992032dc09ca"}
+EOF
+        ;;
+    "test-batch-status")
+        get_batch "${2:-1}"
+        ;;
+    "test-task")
+        get_task "${2:-1}"
+        ;;
+    "test-cancel")
+        cancel_task "${2:-1}"
+        ;;
+    "test-delete")
+        delete_file "${2:-1}"
+        ;;
+    "test-queue")
+        get_queue
+        ;;
+    "test-bandwidth")
+        if [ -z "$2" ]; then
+            get_bandwidth
+        else
+            set_bandwidth "$2"
+        fi
+        ;;
+    "test-events")
+        get_events
+        ;;
     "test-light")
         download_single "http://www.sample-videos.com/video/mp4/720/big_buck_bunny_720p_1mb.mp4" "d55bddf8d62910879ed9f605522149a8"
         ;;
@@ -48,7 +123,7 @@ case "$1" in
         download_single "http://www.sample-videos.com/video/mp4/720/big_buck_bunny_720p_3mb.mp4" "${INVALID_HASH}"
         ;;
     *)
-        echo "Usage: $(basename $0) <build> | <run> | <run-docker> | <test-web> | <test-web-params> | <test-light> | <test-heavy>"
+        echo "Usage: $(basename $0) <build> | <run> | <run-docker> | <run-minio> | <test-web> | <test-web-params> | <test-task> [id] | <test-cancel> [id] | <test-delete> [id] | <test-queue> | <test-bandwidth> [bytes/sec] | <test-events> | <test-light> | <test-heavy> | <test-batch> | <test-batch-status> [id]"
         exit 1
        ;;
 esac
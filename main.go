@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"math/rand"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/blobstore"
 	"github.com/dk13danger/media-service/config"
 	"github.com/dk13danger/media-service/server"
 	"github.com/dk13danger/media-service/service"
@@ -12,10 +15,15 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-var cfgFile = flag.String("config", "cfg/dev.yml", "path to config (default: cfg/dev.yml)")
+var (
+	cfgFile     = flag.String("config", "cfg/dev.yml", "path to config (default: cfg/dev.yml)")
+	migrateOnly = flag.Bool("migrate-only", false, "apply pending db migrations and exit")
+)
 
 func main() {
 	flag.Parse()
+	// Retry delays are randomized, so replicas don't retry failed tasks in lockstep.
+	rand.Seed(time.Now().UnixNano())
 	cfg := config.MustInit(*cfgFile)
 
 	logger := logrus.New()
@@ -25,15 +33,24 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	sqLiteProvider := storage.NewSqliteStorage(logger, cfg.DbFilepath)
+	storageProvider := storage.New(logger, &cfg.Storage)
+	if *migrateOnly {
+		logger.Info("Db migrations applied")
+		return
+	}
+
+	blobs := blobstore.New(&cfg.BlobStore)
 	cacheManager := service.NewCacheManager(logger, &cfg.CacheManager)
+	notifier := service.NewNotifier(storageProvider, logger, &cfg.Notifier)
+	notifier.Run()
 
-	srv := service.NewService(sqLiteProvider, cacheManager, logger, &cfg.Service)
-	downloadQueue := srv.Run()
+	srv := service.NewService(storageProvider, blobs, cacheManager, notifier, logger, &cfg.Service)
+	srv.Run()
 
-	web := server.NewServer(sqLiteProvider, logger, &cfg.Server)
-	web.Run(downloadQueue)
+	web := server.NewServer(storageProvider, srv, logger, &cfg.Server)
+	web.Run()
 
 	srv.Stop()
+	notifier.Stop()
 	logger.Debug("Service stopped")
 }
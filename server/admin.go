@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/config"
+	"github.com/dk13danger/media-service/service"
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth allows requests with `Authorization: Bearer <token>` header, all requests are forbidden if token is empty.
+func adminAuth(token string, logger *logrus.Logger) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if token == "" {
+			logger.Errorf("Admin request %s %s is forbidden: admin token is not configured", c.Request.Method, c.Request.URL.Path)
+			c.JSON(http.StatusForbidden, gin.H{"error": "admin endpoints are disabled"})
+			c.Abort()
+			return
+		}
+
+		given := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			logger.Errorf("Admin request %s %s is unauthorized", c.Request.Method, c.Request.URL.Path)
+			c.Header("WWW-Authenticate", "Bearer")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func bandwidthHandler(srv *service.Service) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, srv.Bandwidth())
+	}
+}
+
+// setBandwidthHandler replaces global bandwidth limit and schedules, they are kept till restart.
+func setBandwidthHandler(srv *service.Service, logger *logrus.Logger) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		cfg := config.Bandwidth{}
+		if err := json.Unmarshal(body, &cfg); err != nil {
+			msg := fmt.Sprintf("Bad request: bandwidth is not valid JSON object: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		if err := srv.SetBandwidth(cfg); err != nil {
+			msg := fmt.Sprintf("Bad request: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusOK, srv.Bandwidth())
+	}
+}
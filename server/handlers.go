@@ -1,62 +1,514 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	net_url "net/url"
+	"strconv"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/checksum"
 	"github.com/dk13danger/media-service/service"
 	"github.com/dk13danger/media-service/storage"
 	"github.com/gin-gonic/gin"
 )
 
-func downloadHandler(downloadQueue chan<- *service.Task, logger *logrus.Logger) func(c *gin.Context) {
+func downloadHandler(srv *service.Service, logger *logrus.Logger) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		url := c.Query("url")
-		md5 := c.Query("md5")
+		callbackUrl := c.Query("callback_url")
 
-		if err := validateQueryParams(url, md5); err != nil {
+		sum, err := validateQueryParams(url, c.Request.URL.Query())
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		if err := validateCallbackUrl(callbackUrl); err != nil {
+			msg := fmt.Sprintf("Bad request: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		priority, err := storage.ParsePriority(c.DefaultQuery("priority", "normal"))
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		fileId, err := srv.Enqueue(&storage.FileModel{
+			Url:         url,
+			Hash:        sum.Digest,
+			HashAlgo:    sum.Algorithm,
+			CallbackUrl: callbackUrl,
+		}, priority)
+		if err == service.ErrQueueFull {
+			rejectTask(c, srv, logger)
+			return
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+
+		position, err := srv.Position(fileId)
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"id":         fileId,
+			"position":   position,
+			"status_url": fmt.Sprintf("/tasks/%d", fileId),
+		})
+	}
+}
+
+// maxBatchSize limits count of items in one batch.
+const maxBatchSize = 1000
+
+// maxBatchBodySize limits size of the batch request body in bytes, so it can't exhaust memory.
+const maxBatchBodySize = 4 << 20
+
+// batchHandler enqueues all items of the batch or none of them, if any item is invalid or queue has no room.
+// Items are objects with the same fields as `/dl` query params (e.g. `{"url": "...", "md5": "..."}`),
+// given either by JSON array or by newline delimited JSON.
+func batchHandler(srv *service.Service, logger *logrus.Logger) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		priority, err := storage.ParsePriority(c.DefaultQuery("priority", "normal"))
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		if c.Request.ContentLength > maxBatchBodySize {
+			msg := fmt.Sprintf("Bad request: batch is larger than %d bytes", maxBatchBodySize)
+			logger.Errorf(msg)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": msg})
+			return
+		}
+		// Body of unknown length is limited while it is read.
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBodySize))
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		items, err := parseBatch(body)
+		if err != nil {
 			msg := fmt.Sprintf("Bad request: %v", err)
 			logger.Errorf(msg)
 			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
 			return
 		}
 
-		downloadQueue <- &service.Task{
-			Url:  url,
-			Hash: md5,
+		files := make([]*storage.FileModel, 0, len(items))
+		results := make([]gin.H, 0, len(items))
+		invalid := 0
+		for i, item := range items {
+			file, err := validateBatchItem(item)
+			result := gin.H{"index": i}
+			if file != nil {
+				result["url"] = file.Url
+			}
+			if err != nil {
+				result["error"] = err.Error()
+				invalid++
+			}
+			files = append(files, file)
+			results = append(results, result)
+		}
+		if invalid > 0 {
+			msg := fmt.Sprintf("Bad request: %d of %d items are invalid", invalid, len(items))
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg, "items": results})
+			return
+		}
+
+		batchId, fileIds, err := srv.EnqueueBatch(files, priority)
+		if err == service.ErrQueueFull {
+			rejectTask(c, srv, logger)
+			return
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+
+		for i, fileId := range fileIds {
+			results[i]["id"] = fileId
+			results[i]["status_url"] = fmt.Sprintf("/tasks/%d", fileId)
+		}
+		logger.Infof("Batch %d of %d items is queued", batchId, len(fileIds))
+		c.JSON(http.StatusAccepted, gin.H{
+			"id":         batchId,
+			"status_url": fmt.Sprintf("/batches/%d", batchId),
+			"items":      results,
+		})
+	}
+}
+
+// parseBatch splits request body into raw items: body is either JSON array or newline delimited JSON.
+func parseBatch(body []byte) ([]json.RawMessage, error) {
+	body = bytes.TrimSpace(body)
+	items := make([]json.RawMessage, 0)
+	if bytes.HasPrefix(body, []byte("[")) {
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, fmt.Errorf("batch is not valid JSON array: %v", err)
+		}
+	} else {
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				items = append(items, json.RawMessage(line))
+			}
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("batch is empty")
+	}
+	if len(items) > maxBatchSize {
+		return nil, fmt.Errorf("batch contains %d items, at most %d are allowed", len(items), maxBatchSize)
+	}
+	return items, nil
+}
+
+// validateBatchItem validates item as `/dl` query params and returns file to enqueue.
+func validateBatchItem(item json.RawMessage) (*storage.FileModel, error) {
+	fields := make(map[string]string)
+	if err := json.Unmarshal(item, &fields); err != nil {
+		return nil, fmt.Errorf("item must be JSON object with string fields: %v", err)
+	}
+
+	params := make(net_url.Values, len(fields))
+	for name, value := range fields {
+		params.Set(name, value)
+	}
+
+	file := &storage.FileModel{
+		Url:         params.Get("url"),
+		CallbackUrl: params.Get("callback_url"),
+	}
+	sum, err := validateQueryParams(file.Url, params)
+	if err != nil {
+		return file, err
+	}
+	if err = validateCallbackUrl(file.CallbackUrl); err != nil {
+		return file, err
+	}
+	file.Hash = sum.Digest
+	file.HashAlgo = sum.Algorithm
+	return file, nil
+}
+
+// rejectTask asks client to slow down and retry later, because queue is saturated.
+func rejectTask(c *gin.Context, srv *service.Service, logger *logrus.Logger) {
+	retryAfter := int(srv.RetryAfter().Seconds())
+	stat, err := srv.Queue()
+	if err != nil {
+		logger.Errorf("Can't get queue state: %v", err)
+	}
+	logger.Errorf("Task is rejected: queue is full (depth: %d, capacity: %d)", stat.Depth, stat.Capacity)
+
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       service.ErrQueueFull.Error(),
+		"retry_after": retryAfter,
+		"queue":       stat,
+	})
+}
+
+func queueHandler(srv *service.Service, logger *logrus.Logger) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		stat, err := srv.Queue()
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusOK, stat)
+	}
+}
+
+func taskHandler(storageProvider storage.Storager, logger *logrus.Logger) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		fileId, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: task id %q is invalid", c.Param("id"))
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		file, err := storageProvider.SelectFileById(fileId)
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+		if file == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Task %d not found", fileId)})
+			return
+		}
+
+		logs, err := storageProvider.SelectLogs(fileId)
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+
+		// Task without any log records is still waiting in the queue.
+		state := "queued"
+		history := make([]gin.H, 0, len(logs))
+		for _, l := range logs {
+			state = storage.StatusName(l.Status)
+			history = append(history, gin.H{
+				"status":  state,
+				"message": l.Message,
+			})
+		}
+
+		var media interface{}
+		if file.MediaInfo != "" {
+			media = json.RawMessage(file.MediaInfo)
 		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":         file.Id,
+			"url":        file.Url,
+			"hash":       file.Hash,
+			"hash_algo":  file.HashAlgo,
+			"state":      state,
+			"bitrate":    file.BitRate,
+			"resolution": file.Resolution,
+			"location":   file.Location,
+			"media":      media,
+			"log":        history,
+		})
 	}
 }
 
-func statisticHandler(storageProvider storage.Storager, logger *logrus.Logger) func(c *gin.Context) {
+func batchStatusHandler(
+	srv *service.Service,
+	storageProvider storage.Storager,
+	logger *logrus.Logger,
+) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		batchId, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: batch id %q is invalid", c.Param("id"))
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		batch, err := storageProvider.SelectBatch(batchId)
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+		if batch == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Batch %d not found", batchId)})
+			return
+		}
+
+		// Batch is finished when every its task is completed, failed or cancelled.
+		finished := true
+		states := make(map[string]int)
+		tasks := make([]gin.H, 0, len(batch.Files))
+		for _, file := range batch.Files {
+			state := "queued"
+			if file.Status != 0 {
+				state = storage.StatusName(file.Status)
+			}
+			switch file.Status {
+			case storage.STATUS_COMPLETED, storage.STATUS_FAILED, storage.STATUS_CANCELLED:
+			default:
+				finished = false
+			}
+			states[state]++
+
+			task := gin.H{
+				"id":         file.FileId,
+				"url":        file.Url,
+				"hash":       file.Hash,
+				"hash_algo":  file.HashAlgo,
+				"state":      state,
+				"status_url": fmt.Sprintf("/tasks/%d", file.FileId),
+			}
+			if progress, ok := srv.Progress(file.FileId); ok {
+				task["progress"] = progress
+			}
+			tasks = append(tasks, task)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":         batch.Id,
+			"created_at": batch.CreatedAt,
+			"total":      len(batch.Files),
+			"finished":   finished,
+			"states":     states,
+			"tasks":      tasks,
+		})
+	}
+}
+
+func cancelHandler(
+	srv *service.Service,
+	storageProvider storage.Storager,
+	logger *logrus.Logger,
+) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		fileId, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: task id %q is invalid", c.Param("id"))
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		file, err := storageProvider.SelectFileById(fileId)
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+		if file == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Task %d not found", fileId)})
+			return
+		}
+
+		err = srv.Cancel(fileId)
+		if err == service.ErrTaskNotCancellable {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Task %d can't be cancelled: %v", fileId, err)})
+			return
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+
+		logger.Infof("Task %d is cancelled by client %s", fileId, c.ClientIP())
+		c.JSON(http.StatusAccepted, gin.H{
+			"id":         fileId,
+			"status_url": fmt.Sprintf("/tasks/%d", fileId),
+		})
+	}
+}
+
+// deleteFileHandler deletes finished file, stored content is removed when no other file is linked to it.
+func deleteFileHandler(
+	srv *service.Service,
+	storageProvider storage.Storager,
+	logger *logrus.Logger,
+) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		fileId, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			msg := fmt.Sprintf("Bad request: file id %q is invalid", c.Param("id"))
+			logger.Errorf(msg)
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		file, err := storageProvider.SelectFileById(fileId)
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+		if file == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("File %d not found", fileId)})
+			return
+		}
+
+		err = srv.DeleteFile(fileId)
+		if err == service.ErrFileBusy {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("File %d can't be deleted: %v", fileId, err)})
+			return
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+
+		logger.Infof("File %d is deleted by client %s", fileId, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{"id": fileId})
+	}
+}
+
+func statisticHandler(
+	srv *service.Service,
+	storageProvider storage.Storager,
+	logger *logrus.Logger,
+) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		url := c.Query("url")
-		md5 := c.Query("md5")
 
-		if url == "" || md5 == "" {
+		// Statistics of one download are selected by url and checksum, otherwise all downloads are listed.
+		if url == "" || !hasChecksumParam(c.Request.URL.Query()) {
 			logger.Infof("Trying to get full statistics")
-			b, err := storageProvider.GetStatistic()
+			stat, err := storageProvider.GetStatistic()
 			if err != nil {
 				msg := fmt.Sprintf("Ooops: %v", err)
 				logger.Errorf(msg)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
 				return
 			}
-			c.String(http.StatusOK, "%s\n", b)
+			withProgress(srv, stat)
+			if err := withNextAttempts(srv, stat); err != nil {
+				msg := fmt.Sprintf("Ooops: %v", err)
+				logger.Errorf(msg)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				return
+			}
+			c.JSON(http.StatusOK, stat)
 			return
 		}
 
-		if err := validateQueryParams(url, md5); err != nil {
+		sum, err := validateQueryParams(url, c.Request.URL.Query())
+		if err != nil {
 			msg := fmt.Sprintf("Bad request: %v", err)
 			logger.Errorf(msg)
 			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
 			return
 		}
 
-		logger.Infof("Trying to get statistics by url: %q, hash: %q", url, md5)
-		b, err := storageProvider.GetStatisticByUrl(url, md5)
+		logger.Infof("Trying to get statistics by url: %q, hash: %q", url, sum)
+		stat, err := storageProvider.GetStatisticByUrl(url, sum.Digest)
 		if err != nil {
 			msg := fmt.Sprintf("Ooops: %v", err)
 			logger.Errorf(msg)
@@ -64,16 +516,211 @@ func statisticHandler(storageProvider storage.Storager, logger *logrus.Logger) f
 			return
 		}
 
-		c.String(http.StatusOK, "%s\n", b)
+		withProgress(srv, stat)
+		if err := withNextAttempts(srv, stat); err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusOK, stat)
+	}
+}
+
+// withProgress adds downloading progress to the in-flight files.
+func withProgress(srv *service.Service, stat storage.Statistic) {
+	for _, file := range stat {
+		if progress, ok := srv.Progress(file["id"].(int)); ok {
+			file["progress"] = progress
+		}
 	}
 }
 
-func validateQueryParams(url string, md5 string) error {
-	if _, err := net_url.ParseRequestURI(url); err != nil {
+// withNextAttempts adds count of failed attempts and time of the next one (unix timestamp)
+// to the files waiting for retry.
+func withNextAttempts(srv *service.Service, stat storage.Statistic) error {
+	delayed, err := srv.DelayedTasks()
+	if err != nil {
 		return err
 	}
-	if md5 == "" && len(md5) != 32 {
-		return fmt.Errorf("hash length invalid. Must be: %d", 32)
+	for _, file := range stat {
+		if job, ok := delayed[file["id"].(int)]; ok {
+			file["attempts"] = job.Attempts
+			file["next_attempt_at"] = job.AvailableAt
+		}
+	}
+	return nil
+}
+
+func filesHandler(storageProvider storage.Storager, logger *logrus.Logger) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		filter := &storage.MediaStreamFilter{
+			CodecType: c.Query("codec_type"),
+			CodecName: c.Query("codec_name"),
+			Language:  c.Query("language"),
+		}
+
+		var err error
+		var minBitRate int
+		for name, value := range map[string]*int{
+			"width":        &filter.Width,
+			"height":       &filter.Height,
+			"min_bit_rate": &minBitRate,
+		} {
+			if *value, err = intQuery(c, name); err != nil {
+				msg := fmt.Sprintf("Bad request: %v", err)
+				logger.Errorf(msg)
+				c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+				return
+			}
+		}
+		filter.MinBitRate = int64(minBitRate)
+
+		files, err := storageProvider.SelectFilesByMediaStream(filter)
+		if err != nil {
+			msg := fmt.Sprintf("Ooops: %v", err)
+			logger.Errorf(msg)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			return
+		}
+
+		ret := make([]gin.H, 0, len(files))
+		for _, file := range files {
+			ret = append(ret, gin.H{
+				"id":         file.Id,
+				"url":        file.Url,
+				"hash":       file.Hash,
+				"hash_algo":  file.HashAlgo,
+				"bitrate":    file.BitRate,
+				"resolution": file.Resolution,
+				"location":   file.Location,
+			})
+		}
+		c.JSON(http.StatusOK, ret)
+	}
+}
+
+// intQuery returns zero if query param is not set.
+func intQuery(c *gin.Context, name string) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("param %q must be integer", name)
+	}
+	return n, nil
+}
+
+// eventsKeepAlive is the interval of comments sent to idle event stream,
+// so proxies don't close the connection.
+const eventsKeepAlive = 15 * time.Second
+
+func eventsHandler(srv *service.Service, done <-chan struct{}, logger *logrus.Logger) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		filter := service.EventFilter{}
+
+		if id := c.Query("id"); id != "" {
+			taskId, err := strconv.Atoi(id)
+			if err != nil {
+				msg := fmt.Sprintf("Bad request: task id %q is invalid", id)
+				logger.Errorf(msg)
+				c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+				return
+			}
+			filter.TaskId = taskId
+		}
+
+		if url := c.Query("url"); url != "" {
+			sum, err := validateQueryParams(url, c.Request.URL.Query())
+			if err != nil {
+				msg := fmt.Sprintf("Bad request: %v", err)
+				logger.Errorf(msg)
+				c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+				return
+			}
+			filter.Url = url
+			filter.Hash = sum.Digest
+		}
+
+		events, unsubscribe := srv.Subscribe(filter)
+		defer unsubscribe()
+
+		logger.Infof("Client %s subscribed to events", c.ClientIP())
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+
+		keepAlive := time.NewTicker(eventsKeepAlive)
+		defer keepAlive.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case e := <-events:
+				c.SSEvent(e.Type, e)
+				return true
+			case <-keepAlive.C:
+				fmt.Fprint(w, ":keep-alive\n\n")
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			case <-done:
+				return false
+			}
+		})
+		logger.Infof("Client %s unsubscribed from events", c.ClientIP())
+	}
+}
+
+// validateQueryParams validates url and returns checksum given either by
+// `checksum=<algorithm>:<hex>` or by `<algorithm>=<hex>` (e.g. `md5=<hex>`, `sha256=<hex>`) param.
+func validateQueryParams(url string, params net_url.Values) (*checksum.Checksum, error) {
+	if err := validateHttpUrl("url", url); err != nil {
+		return nil, err
+	}
+	if value := params.Get("checksum"); value != "" {
+		return checksum.Parse(value)
+	}
+	for _, algorithm := range checksum.Names() {
+		if digest := params.Get(algorithm); digest != "" {
+			return checksum.New(algorithm, digest)
+		}
+	}
+	return nil, fmt.Errorf("checksum is required. Use `checksum=<algorithm>:<hex>` or one of params: %v", checksum.Names())
+}
+
+// hasChecksumParam reports whether checksum is set by any of params accepted by validateQueryParams.
+func hasChecksumParam(params net_url.Values) bool {
+	if params.Get("checksum") != "" {
+		return true
+	}
+	for _, algorithm := range checksum.Names() {
+		if params.Get(algorithm) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCallbackUrl checks optional callback url, only http(s) urls are allowed.
+func validateCallbackUrl(callbackUrl string) error {
+	if callbackUrl == "" {
+		return nil
+	}
+	return validateHttpUrl("callback url", callbackUrl)
+}
+
+// validateHttpUrl checks that url is absolute http(s) url with host.
+func validateHttpUrl(name, url string) error {
+	u, err := net_url.ParseRequestURI(url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s scheme %q is not supported", name, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%s %q has no host", name, url)
 	}
 	return nil
 }
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	net_url "net/url"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/config"
+	"github.com/dk13danger/media-service/service"
+	"github.com/dk13danger/media-service/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseBatch(t *testing.T) {
+	tests := []struct {
+		body  string
+		items int
+		err   bool
+	}{
+		{`[{"url": "http://a/1"}, {"url": "http://a/2"}]`, 2, false},
+		{"{\"url\": \"http://a/1\"}\n\n{\"url\": \"http://a/2\"}\n", 2, false},
+		{`[{"url": "http://a/1"}`, 0, true},
+		{`[]`, 0, true},
+		{"  \n", 0, true},
+		{strings.Repeat("{}\n", maxBatchSize), maxBatchSize, false},
+		{strings.Repeat("{}\n", maxBatchSize+1), 0, true},
+	}
+	for i, test := range tests {
+		items, err := parseBatch([]byte(test.body))
+		if (err != nil) != test.err {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if len(items) != test.items {
+			t.Errorf("#%d: expected %d items, got %d", i, test.items, len(items))
+		}
+	}
+}
+
+func TestBatchBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	router := gin.New()
+	// Body is rejected before the service is used.
+	router.POST("/dl/batch", batchHandler(nil, logger))
+
+	body := bytes.Repeat([]byte{' '}, maxBatchBodySize+1)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/dl/batch", bytes.NewReader(body)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body of known length: expected %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	// Chunked body has unknown length, it is cut while read.
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/dl/batch", ioutil.NopCloser(bytes.NewReader(body)))
+	req.ContentLength = -1
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("body of unknown length: expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestValidateQueryParams(t *testing.T) {
+	params := net_url.Values{"md5": {"d41d8cd98f00b204e9800998ecf8427e"}}
+	tests := []struct {
+		url string
+		err bool
+	}{
+		{"http://example.com/a.mp4", false},
+		{"https://example.com:8443/a.mp4?b=c", false},
+		{"file:///etc/passwd", true},
+		{"ftp://example.com/a.mp4", true},
+		{"gopher://example.com/", true},
+		{"http:///a.mp4", true},
+		{"/a.mp4", true},
+		{"a.mp4", true},
+	}
+	for _, test := range tests {
+		if _, err := validateQueryParams(test.url, params); (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.url, err)
+		}
+	}
+
+	if _, err := validateQueryParams("http://example.com/a.mp4", net_url.Values{}); err == nil {
+		t.Error("expected error for missing checksum")
+	}
+	if err := validateCallbackUrl("file:///tmp/cb"); err == nil {
+		t.Error("expected error for file callback url")
+	}
+	if err := validateCallbackUrl(""); err != nil {
+		t.Errorf("unexpected error for empty callback url: %v", err)
+	}
+}
+
+// TestStatisticWithoutChecksum checks that url without checksum lists all downloads as before checksums were added.
+func TestStatisticWithoutChecksum(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	store := storage.NewMemoryStorage(logger)
+	for _, url := range []string{"http://host/a.mp4", "http://host/b.mp4"} {
+		id, err := store.InsertFile(&storage.FileModel{Url: url, Hash: "d41d8cd98f00b204e9800998ecf8427e", HashAlgo: "md5"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.InsertLog(&storage.LogModel{FileId: id, Status: storage.STATUS_PENDING, Message: "Task created"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifier := service.NewNotifier(store, logger, &config.Notifier{})
+	cacheManager := service.NewCacheManager(logger, &config.CacheManager{Size: 10})
+	srv := service.NewService(store, nil, cacheManager, notifier, logger, &config.Service{})
+	router := gin.New()
+	router.GET("/st", statisticHandler(srv, store, logger))
+
+	tests := []struct {
+		query string
+		files int
+	}{
+		{"", 2},
+		{"?url=http://host/a.mp4", 2},
+		{"?url=http://host/a.mp4&md5=d41d8cd98f00b204e9800998ecf8427e", 1},
+		{"?url=http://host/a.mp4&checksum=md5:d41d8cd98f00b204e9800998ecf8427e", 1},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/st"+test.query, nil))
+		var stat map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &stat); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%q: expected %d, got %d %s", test.query, http.StatusOK, w.Code, w.Body.String())
+		}
+		if len(stat) != test.files {
+			t.Errorf("%q: expected %d files, got %d", test.query, test.files, len(stat))
+		}
+	}
+}
@@ -17,44 +17,33 @@ import (
 
 type Server struct {
 	storage storage.Storager
+	service *service.Service
 	logger  *logrus.Logger
 	cfg     *config.Server
+	done    chan struct{}
 }
 
 func NewServer(
 	storage storage.Storager,
+	service *service.Service,
 	logger *logrus.Logger,
 	cfg *config.Server,
 ) *Server {
 	return &Server{
 		storage: storage,
+		service: service,
 		logger:  logger,
 		cfg:     cfg,
+		done:    make(chan struct{}),
 	}
 }
 
-func (s *Server) Run(downloadQueue chan<- *service.Task) {
-	files, err := s.storage.Select1InterruptFiles()
-	if err != nil {
-		s.logger.Errorf("Can't get list of interrupt tasks: %v", err)
-		return
-	}
-
-	for _, f := range files {
-		s.logger.Infof("Continue downloading interrupted tasks (count: %d)..", len(files))
-		downloadQueue <- &service.Task{
-			Url:  f.Url,
-			Hash: f.Hash,
-		}
-	}
-
-	router := gin.Default()
-	router.GET("/dl", downloadHandler(downloadQueue, s.logger))
-	router.GET("/st", statisticHandler(s.storage, s.logger))
-
+// Run serves http requests until interrupt signal.
+// Interrupted tasks don't need to be restored: they are left in the jobs queue and claimed by workers again.
+func (s *Server) Run() {
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", s.cfg.Port),
-		Handler: router,
+		Handler: s.router(),
 	}
 
 	go func() {
@@ -67,6 +56,8 @@ func (s *Server) Run(downloadQueue chan<- *service.Task) {
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 	s.logger.Println("Server shutdown started..")
+	// Event streams never end by themselves, so close them before waiting for active connections.
+	close(s.done)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ShutdownTimeout)*time.Second)
 	defer cancel()
@@ -74,3 +65,22 @@ func (s *Server) Run(downloadQueue chan<- *service.Task) {
 		s.logger.Fatalf("Server shutdown err: %v", err)
 	}
 }
+
+func (s *Server) router() *gin.Engine {
+	router := gin.Default()
+	router.GET("/dl", downloadHandler(s.service, s.logger))
+	router.POST("/dl/batch", batchHandler(s.service, s.logger))
+	router.GET("/batches/:id", batchStatusHandler(s.service, s.storage, s.logger))
+	router.GET("/st", statisticHandler(s.service, s.storage, s.logger))
+	router.GET("/tasks/:id", taskHandler(s.storage, s.logger))
+	router.DELETE("/tasks/:id", cancelHandler(s.service, s.storage, s.logger))
+	router.GET("/files", filesHandler(s.storage, s.logger))
+	router.DELETE("/files/:id", deleteFileHandler(s.service, s.storage, s.logger))
+	router.GET("/events", eventsHandler(s.service, s.done, s.logger))
+	router.GET("/queue", queueHandler(s.service, s.logger))
+
+	admin := router.Group("/admin", adminAuth(s.cfg.AdminToken, s.logger))
+	admin.GET("/bandwidth", bandwidthHandler(s.service))
+	admin.PUT("/bandwidth", setBandwidthHandler(s.service, s.logger))
+	return router
+}
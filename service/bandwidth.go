@@ -0,0 +1,151 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dk13danger/media-service/config"
+)
+
+// BandwidthStat describes global bandwidth limit: configured limit, schedules and the limit
+// effective now (bytes per second, zero means unlimited).
+type BandwidthStat struct {
+	config.Bandwidth
+	Effective int64 `json:"effective"`
+}
+
+// bandwidthSchedule is parsed config.BandwidthSchedule, start and end are minutes of the day.
+type bandwidthSchedule struct {
+	start int
+	end   int
+	limit int64
+}
+
+func (s bandwidthSchedule) matches(minute int) bool {
+	switch {
+	case s.start < s.end:
+		return minute >= s.start && minute < s.end
+	case s.start > s.end:
+		return minute >= s.start || minute < s.end
+	}
+	return true
+}
+
+// bandwidthLimiter limits total download speed of all workers, limit can be changed at runtime.
+// Limit isn't shared by service replicas.
+type bandwidthLimiter struct {
+	mu        sync.Mutex
+	cfg       config.Bandwidth
+	schedules []bandwidthSchedule
+	limit     int64
+	bucket    *tokenBucket
+}
+
+func newBandwidthLimiter(cfg config.Bandwidth) (*bandwidthLimiter, error) {
+	l := &bandwidthLimiter{}
+	if err := l.Set(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Set replaces limit and schedules, returns error if config is invalid.
+func (l *bandwidthLimiter) Set(cfg config.Bandwidth) error {
+	if cfg.Limit < 0 {
+		return fmt.Errorf("limit %d is negative", cfg.Limit)
+	}
+	schedules := make([]bandwidthSchedule, 0, len(cfg.Schedules))
+	for i, sc := range cfg.Schedules {
+		start, err := parseClock(sc.Start)
+		if err != nil {
+			return fmt.Errorf("schedule %d: start: %v", i, err)
+		}
+		end, err := parseClock(sc.End)
+		if err != nil {
+			return fmt.Errorf("schedule %d: end: %v", i, err)
+		}
+		if sc.Limit < 0 {
+			return fmt.Errorf("schedule %d: limit %d is negative", i, sc.Limit)
+		}
+		schedules = append(schedules, bandwidthSchedule{start: start, end: end, limit: sc.Limit})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	l.schedules = schedules
+	// Bucket is recreated by the next read.
+	l.limit = -1
+	l.bucket = nil
+	return nil
+}
+
+// Stat returns config and the limit effective now.
+func (l *bandwidthLimiter) Stat() BandwidthStat {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return BandwidthStat{Bandwidth: l.cfg, Effective: l.limitAt(time.Now())}
+}
+
+func (l *bandwidthLimiter) limitAt(now time.Time) int64 {
+	minute := now.Hour()*60 + now.Minute()
+	for _, sc := range l.schedules {
+		if sc.matches(minute) {
+			return sc.limit
+		}
+	}
+	return l.cfg.Limit
+}
+
+// current returns bucket of the limit effective now, nil if bandwidth is unlimited.
+func (l *bandwidthLimiter) current() *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit := l.limitAt(time.Now()); limit != l.limit {
+		l.limit = limit
+		l.bucket = nil
+		if limit > 0 {
+			l.bucket = newTokenBucket(float64(limit), float64(limit))
+		}
+	}
+	return l.bucket
+}
+
+func (l *bandwidthLimiter) Reserve(n int) time.Duration {
+	if bucket := l.current(); bucket != nil {
+		return bucket.Reserve(n)
+	}
+	return 0
+}
+
+func (l *bandwidthLimiter) Burst() int {
+	if bucket := l.current(); bucket != nil {
+		return bucket.Burst()
+	}
+	return 0
+}
+
+// parseClock returns minute of the day of "HH:MM" time.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time %q is not in HH:MM format", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Bandwidth returns global bandwidth limit of the service.
+func (s *Service) Bandwidth() BandwidthStat {
+	return s.bandwidth.Stat()
+}
+
+// SetBandwidth replaces global bandwidth limit and schedules till restart, it is applied to in-flight downloads too.
+func (s *Service) SetBandwidth(cfg config.Bandwidth) error {
+	if err := s.bandwidth.Set(cfg); err != nil {
+		return err
+	}
+	s.logger.Infof("Bandwidth limit is changed: %d bytes/sec, %d schedules", cfg.Limit, len(cfg.Schedules))
+	return nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/dk13danger/media-service/checksum"
+	"github.com/dk13danger/media-service/storage"
+)
+
+// ErrFileBusy is returned when file can't be deleted because its task is queued or in progress.
+var ErrFileBusy = errors.New("task of the file is queued or in progress")
+
+// blobDigest returns content address of the task file. Checksum which is too weak to identify content
+// gets address unique for the task, so its file is never shared.
+func blobDigest(t *Task) string {
+	if t.HashAlgo == checksum.CRC32C {
+		return fmt.Sprintf("%s:%s#%d", t.HashAlgo, t.Hash, t.Id)
+	}
+	return fmt.Sprintf("%s:%s", t.HashAlgo, t.Hash)
+}
+
+// blobKey returns key of the task file in the blob store, so stored file keeps its name. File name starts
+// with task id, so key is unique for the task and blob released by deleted files can't be overwritten
+// by the same content uploaded meanwhile.
+func blobKey(t *Task, fileName string) string {
+	return fmt.Sprintf("%s/%s-%s", t.HashAlgo, t.Hash, fileName)
+}
+
+// linkTask completes task by the blob of the same content stored before, so file isn't downloaded again.
+func (s *Service) linkTask(t *Task, blob *storage.BlobModel) error {
+	mediaInfo := &MediaInfo{}
+	if err := json.Unmarshal([]byte(blob.MediaInfo), mediaInfo); err != nil {
+		return s.failTask(t, fmt.Sprintf("Error while unmarshalling media info of blob %q: %v", blob.Digest, err))
+	}
+	s.logToStorage(t, storage.STATUS_PENDING, fmt.Sprintf("File is deduplicated: content is already stored: %q", blob.Location))
+	return s.completeTask(t, mediaInfo, blob.MediaInfo, blob.Location)
+}
+
+// storeFile puts processed file into the blob store and links task to its blob. If the same content
+// is stored by another task meanwhile, the file is removed and task is linked to the blob stored first.
+func (s *Service) storeFile(ctx context.Context, t *Task, filePath, mediaInfo string) (string, error) {
+	key := blobKey(t, filepath.Base(filePath))
+	location, err := s.blobs.Put(ctx, key, filePath)
+	if err != nil {
+		return "", err
+	}
+
+	blob, err := s.storage.InsertBlob(t.Id, &storage.BlobModel{
+		Digest:    blobDigest(t),
+		Key:       key,
+		Location:  location,
+		MediaInfo: mediaInfo,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		s.deleteBlob(key)
+		return "", err
+	}
+	if blob.Key != key {
+		s.logger.Infof("Content of task %d is stored by another task meanwhile: %q", t.Id, blob.Location)
+		s.deleteBlob(key)
+	}
+	return blob.Location, nil
+}
+
+func (s *Service) deleteBlob(key string) {
+	if err := s.blobs.Delete(context.Background(), key); err != nil {
+		s.logger.Errorf("Can't remove blob %q: %v", key, err)
+	}
+}
+
+// DeleteFile deletes file with its history and partial download. Stored file is removed
+// from the blob store when the last file linked to it is deleted.
+func (s *Service) DeleteFile(fileId int) error {
+	file, err := s.storage.SelectFileById(fileId)
+	if err != nil || file == nil {
+		return err
+	}
+	deleted, blob, err := s.storage.DeleteFile(fileId)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrFileBusy
+	}
+
+	t := &Task{Id: file.Id, Url: file.Url, Hash: file.Hash, HashAlgo: file.HashAlgo}
+	s.removePartFile(t)
+
+	switch {
+	case blob != nil:
+		s.deleteBlob(blob.Key)
+	case file.BlobDigest == "" && file.Location != "":
+		// File processed before deduplication owns its blob, key is taken from its location.
+		key, err := s.blobs.Key(file.Location)
+		if err != nil {
+			s.logger.Errorf("Can't remove blob of file %d: %v", file.Id, err)
+			break
+		}
+		s.deleteBlob(key)
+	}
+	return nil
+}
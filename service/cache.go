@@ -1,6 +1,7 @@
 package service
 
 import (
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -11,6 +12,7 @@ import (
 type CacheManager struct {
 	logger *logrus.Logger
 	cache  gcache.Cache
+	mu     sync.Mutex
 }
 
 func NewCacheManager(
@@ -28,9 +30,23 @@ func NewCacheManager(
 }
 
 func (c *CacheManager) Set(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.cache.Set(key, true)
 }
 
+// TrySet sets the key if it isn't set yet. Returns false if the key is already set,
+// so only one of concurrent callers gets the key.
+func (c *CacheManager) TrySet(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Get(key) {
+		return false
+	}
+	c.cache.Set(key, true)
+	return true
+}
+
 func (c *CacheManager) Remove(key string) {
 	c.cache.Remove(key)
 }
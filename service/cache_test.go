@@ -0,0 +1,35 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/config"
+)
+
+func TestCacheManagerTrySet(t *testing.T) {
+	c := NewCacheManager(logrus.New(), &config.CacheManager{Size: 10, Expiration: 60})
+
+	var wg sync.WaitGroup
+	var acquired int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.TrySet("md5:hash") {
+				atomic.AddInt32(&acquired, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired != 1 {
+		t.Fatalf("key is acquired %d times; want once", acquired)
+	}
+
+	c.Remove("md5:hash")
+	if !c.TrySet("md5:hash") {
+		t.Fatal("removed key isn't acquired")
+	}
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dk13danger/media-service/storage"
+)
+
+// ErrTaskNotCancellable is returned when task is neither queued nor in progress.
+var ErrTaskNotCancellable = errors.New("task is neither queued nor in progress")
+
+// Cancel removes queued task or aborts in-flight one.
+// Task processed by this service replica is aborted at once, by another one - on its next lease extension.
+func (s *Service) Cancel(fileId int) error {
+	now := time.Now().Unix()
+	deleted, err := s.storage.DeleteQueuedJob(fileId, now)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		// Queued task may have partial download of the interrupted or failed attempt.
+		s.removePartFile(&Task{Id: fileId})
+		file, err := s.storage.SelectFileById(fileId)
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			s.logToStorage(&Task{
+				Id:       file.Id,
+				Url:      file.Url,
+				Hash:     file.Hash,
+				HashAlgo: file.HashAlgo,
+			}, storage.STATUS_CANCELLED, "Task cancelled while queued")
+		}
+		return nil
+	}
+
+	cancelled, err := s.storage.CancelJob(fileId, now)
+	if err != nil {
+		return err
+	}
+	if !cancelled {
+		return ErrTaskNotCancellable
+	}
+	s.cancels.Cancel(fileId)
+	return nil
+}
+
+// cancelTask removes downloaded (or partially downloaded) file of the aborted task.
+// Returns error if final status isn't logged.
+func (s *Service) cancelTask(t *Task) error {
+	s.removePartFile(t)
+	if err := s.logToStorage(t, storage.STATUS_CANCELLED, "Task cancelled"); err != nil {
+		return fmt.Errorf("error while cancelling task: %v", err)
+	}
+	return nil
+}
+
+// cancelManager keeps cancel functions of in-flight tasks.
+type cancelManager struct {
+	mu      sync.Mutex
+	cancels map[int]context.CancelFunc
+}
+
+func newCancelManager() *cancelManager {
+	return &cancelManager{
+		cancels: make(map[int]context.CancelFunc),
+	}
+}
+
+func (m *cancelManager) Add(fileId int, cancel context.CancelFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cancels[fileId] = cancel
+}
+
+func (m *cancelManager) Remove(fileId int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.cancels, fileId)
+}
+
+func (m *cancelManager) Cancel(fileId int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cancel, ok := m.cancels[fileId]; ok {
+		cancel()
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/config"
+	"github.com/dk13danger/media-service/storage"
+)
+
+// TestDeferCancelledJob checks that cancelled job is aborted right away instead of waiting for its lease expiration.
+func TestDeferCancelledJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	store := storage.NewMemoryStorage(logger)
+	s := &Service{
+		logger:   logger,
+		storage:  store,
+		notifier: NewNotifier(store, logger, &config.Notifier{}),
+		events:   newEventBroker(),
+		cfg:      &config.Service{OutputDir: dir},
+	}
+
+	for _, cancelledBeforeClaim := range []bool{false, true} {
+		now := time.Now().Unix()
+		fileId, err := store.EnqueueFile(&storage.FileModel{Url: "http://host/a.mp4", Hash: "hash", HashAlgo: "md5"}, storage.PRIORITY_NORMAL, now)
+		if err != nil {
+			t.Fatalf("EnqueueFile(): %v", err)
+		}
+		job, err := store.ClaimJob("owner", now, now+60, 0, nil)
+		if err != nil || job == nil {
+			t.Fatalf("ClaimJob() = %+v, %v; want job", job, err)
+		}
+		if ok, err := store.CancelJob(fileId, now); err != nil || !ok {
+			t.Fatalf("CancelJob() = %v, %v; want true", ok, err)
+		}
+		if cancelledBeforeClaim {
+			job.Cancelled = true
+		}
+
+		task := &Task{Id: job.FileId, Url: job.Url, Hash: job.Hash, HashAlgo: job.HashAlgo}
+		s.deferJob(job, "owner", task, time.Second, "the same content is downloading")
+		if current, err := store.SelectJob(job.Id); err != nil || current != nil {
+			t.Fatalf("cancelled (before claim: %v) job is left: %+v, %v", cancelledBeforeClaim, current, err)
+		}
+		logs, err := store.SelectLogs(fileId)
+		if err != nil || len(logs) == 0 || logs[len(logs)-1].Status != storage.STATUS_CANCELLED {
+			t.Fatalf("cancelled (before claim: %v) task logs = %+v, %v; want cancelled status", cancelledBeforeClaim, logs, err)
+		}
+	}
+}
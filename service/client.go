@@ -0,0 +1,168 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dk13danger/media-service/config"
+)
+
+// Defaults of the http client config.
+const (
+	defaultConnectTimeout = 10
+	defaultHeaderTimeout  = 30
+	defaultIdleTimeout    = 60
+	defaultMaxRedirects   = 10
+	defaultUserAgent      = "media-service"
+)
+
+// rejectedError is returned when response is rejected by the http client config.
+type rejectedError struct {
+	message string
+}
+
+func (e *rejectedError) Error() string {
+	return e.message
+}
+
+// idleTimeoutError is returned when download is aborted because no bytes are received for idle timeout.
+type idleTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *idleTimeoutError) Error() string {
+	return fmt.Sprintf("no bytes received for %v", e.timeout)
+}
+
+func (e *idleTimeoutError) Timeout() bool   { return true }
+func (e *idleTimeoutError) Temporary() bool { return true }
+
+// newHttpClient creates client which downloads remote files, zero config fields are replaced by defaults.
+func newHttpClient(cfg *config.HttpClient) *http.Client {
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = defaultConnectTimeout
+	}
+	if cfg.HeaderTimeout <= 0 {
+		cfg.HeaderTimeout = defaultHeaderTimeout
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+	if cfg.MaxRedirects <= 0 {
+		cfg.MaxRedirects = defaultMaxRedirects
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaultUserAgent
+	}
+
+	connectTimeout := time.Duration(cfg.ConnectTimeout) * time.Second
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   connectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: time.Duration(cfg.HeaderTimeout) * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return &rejectedError{fmt.Sprintf("stopped after %d redirects", cfg.MaxRedirects)}
+			}
+			// Redirected requests have to be sent with the same user agent.
+			request.Header.Set("User-Agent", cfg.UserAgent)
+			return nil
+		},
+	}
+}
+
+// checkResponse rejects response which is too large or has content type which isn't allowed.
+// Total is the size of the whole remote file, negative if unknown.
+func checkResponse(cfg *config.HttpClient, response *http.Response, total int64) error {
+	if cfg.MaxBodySize > 0 && total > cfg.MaxBodySize {
+		return &rejectedError{fmt.Sprintf("file size %d bytes exceeds limit of %d bytes", total, cfg.MaxBodySize)}
+	}
+	if len(cfg.AllowedContentTypes) == 0 {
+		return nil
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return &rejectedError{fmt.Sprintf("content type %q is invalid: %v", contentType, err)}
+	}
+	for _, allowed := range cfg.AllowedContentTypes {
+		if allowed == mediaType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1])) {
+			return nil
+		}
+	}
+	return &rejectedError{fmt.Sprintf("content type %q is not allowed", mediaType)}
+}
+
+// limitedReader fails when more than max bytes are read (max isn't positive means unlimited),
+// so file without (or with wrong) Content-Length can't exceed the limit.
+type limitedReader struct {
+	reader io.Reader
+	left   int64
+	max    int64
+}
+
+func newLimitedReader(reader io.Reader, offset, max int64) io.Reader {
+	if max <= 0 {
+		return reader
+	}
+	return &limitedReader{reader: reader, left: max - offset, max: max}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		return n, &rejectedError{fmt.Sprintf("file size exceeds limit of %d bytes", r.max)}
+	}
+	return n, err
+}
+
+// idleReader closes the body when no bytes are received for timeout, so stalled download doesn't hang forever.
+// Timer runs only while the body is read, so time spent by the caller between reads (e.g. waiting
+// for bandwidth limits) isn't idle.
+type idleReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func newIdleReader(body io.ReadCloser, timeout time.Duration) *idleReader {
+	r := &idleReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.expired, 1)
+		body.Close()
+	})
+	r.timer.Stop()
+	return r
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if err != nil && atomic.LoadInt32(&r.expired) == 1 {
+		return n, &idleTimeoutError{r.timeout}
+	}
+	return n, err
+}
+
+// Stop stops the idle timer, it must be called when reading is finished.
+func (r *idleReader) Stop() {
+	r.timer.Stop()
+}
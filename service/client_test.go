@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// delayLimiter allows every read after the fixed delay.
+type delayLimiter time.Duration
+
+func (l delayLimiter) Reserve(n int) time.Duration {
+	return time.Duration(l)
+}
+
+func (l delayLimiter) Burst() int {
+	return 0
+}
+
+// TestIdleReaderThrottled checks that waiting for bandwidth limits longer than idle timeout isn't idle.
+func TestIdleReaderThrottled(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 3; i++ {
+			pw.Write([]byte("chunk"))
+		}
+		pw.Close()
+	}()
+
+	body := newIdleReader(pr, 50*time.Millisecond)
+	defer body.Stop()
+	reader := newThrottledReader(context.Background(), body, delayLimiter(100*time.Millisecond))
+	content, err := ioutil.ReadAll(reader)
+	if err != nil || string(content) != "chunkchunkchunk" {
+		t.Fatalf("ReadAll() = %q, %v; want all chunks", content, err)
+	}
+}
+
+func TestIdleReaderTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	body := newIdleReader(pr, 50*time.Millisecond)
+	defer body.Stop()
+	// Time before the first read isn't idle either.
+	time.Sleep(100 * time.Millisecond)
+	go pw.Write([]byte("chunk"))
+	if n, err := body.Read(make([]byte, 10)); err != nil || n != 5 {
+		t.Fatalf("Read() = %d, %v; want chunk", n, err)
+	}
+
+	start := time.Now()
+	_, err := body.Read(make([]byte, 10))
+	if _, ok := err.(*idleTimeoutError); !ok {
+		t.Fatalf("Read() of stalled body = %v; want idle timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Read() of stalled body returned after %v; want about 50ms", elapsed)
+	}
+}
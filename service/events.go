@@ -0,0 +1,87 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_STATUS   = "status"
+	EVENT_PROGRESS = "progress"
+)
+
+// eventBufferSize is the count of events which can be kept for slow subscriber.
+// Events which don't fit into the buffer are dropped for that subscriber.
+const eventBufferSize = 100
+
+// progressInterval is the interval between progress events of the in-flight task.
+const progressInterval = time.Second
+
+// Event describes task lifecycle transition or downloading progress tick.
+type Event struct {
+	Type     string    `json:"type"`
+	TaskId   int       `json:"task_id"`
+	Url      string    `json:"url"`
+	Hash     string    `json:"hash"`
+	Status   string    `json:"status,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// EventFilter selects events of the one task (by id or url and hash).
+// Empty filter matches all events.
+type EventFilter struct {
+	TaskId int
+	Url    string
+	Hash   string
+}
+
+func (f EventFilter) match(e *Event) bool {
+	if f.TaskId > 0 && f.TaskId != e.TaskId {
+		return false
+	}
+	if f.Url != "" && (f.Url != e.Url || f.Hash != e.Hash) {
+		return false
+	}
+	return true
+}
+
+// eventBroker delivers published events to all matched subscribers.
+type eventBroker struct {
+	mu          sync.RWMutex
+	subscribers map[chan *Event]EventFilter
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subscribers: make(map[chan *Event]EventFilter),
+	}
+}
+
+func (b *eventBroker) Subscribe(filter EventFilter) chan *Event {
+	ch := make(chan *Event, eventBufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[ch] = filter
+	return ch
+}
+
+func (b *eventBroker) Unsubscribe(ch chan *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+func (b *eventBroker) Publish(e *Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch, filter := range b.subscribers {
+		if !filter.match(e) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
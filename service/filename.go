@@ -0,0 +1,135 @@
+package service
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// maxFileNameLength limits name of the output file without extension, so it fits any filesystem.
+	maxFileNameLength = 100
+	// maxExtensionLength limits extension of the output file, longer one is kept as part of the name.
+	maxExtensionLength = 10
+	// defaultFileName is used when neither response nor url gives usable name.
+	defaultFileName = "file"
+)
+
+// mediaExtensions maps media types to extensions. Extensions known by mime package depend on the system
+// and cover only few of media types, so they aren't used.
+var mediaExtensions = map[string]string{
+	"application/vnd.apple.mpegurl": ".m3u8",
+	"audio/aac":                     ".aac",
+	"audio/flac":                    ".flac",
+	"audio/mp4":                     ".m4a",
+	"audio/mpeg":                    ".mp3",
+	"audio/ogg":                     ".ogg",
+	"audio/wav":                     ".wav",
+	"audio/webm":                    ".weba",
+	"video/3gpp":                    ".3gp",
+	"video/mp2t":                    ".ts",
+	"video/mp4":                     ".mp4",
+	"video/mpeg":                    ".mpeg",
+	"video/ogg":                     ".ogv",
+	"video/quicktime":               ".mov",
+	"video/webm":                    ".webm",
+	"video/x-flv":                   ".flv",
+	"video/x-matroska":              ".mkv",
+	"video/x-msvideo":               ".avi",
+}
+
+// outputFileName returns safe name of the downloaded file. Name is taken from `Content-Disposition` header
+// or the last segment of the url path, extension is derived from `Content-Type` if name doesn't have one.
+func outputFileName(rawUrl string, response *http.Response) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(response.Header.Get("Content-Disposition")); err == nil {
+		name = sanitizeFileName(params["filename"])
+	}
+	if name == "" {
+		name = sanitizeFileName(urlFileName(rawUrl))
+	}
+	if name == "" {
+		name = defaultFileName
+	}
+	if fileExtension(name) == "" {
+		name += contentTypeExtension(response.Header.Get("Content-Type"))
+	}
+	return name
+}
+
+// urlFileName returns the last non-empty segment of the url path, query and fragment are ignored.
+func urlFileName(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	// Path is unescaped already, so encoded slashes split segments too.
+	p := strings.TrimRight(u.Path, "/")
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+// sanitizeFileName keeps ASCII letters, digits, `-`, `_` and `.` of the name, other runs of characters
+// are replaced by `_`. Dots around the name are removed, so it can't be hidden, `.` or `..`.
+// Empty string is returned if nothing is left of the name without extension.
+func sanitizeFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	ret := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' {
+			ret = append(ret, c)
+		} else if len(ret) > 0 && ret[len(ret)-1] != '_' {
+			ret = append(ret, '_')
+		}
+	}
+	name = string(ret)
+
+	ext := fileExtension(name)
+	base := strings.Trim(strings.TrimSuffix(name, ext), "._")
+	if len(base) > maxFileNameLength {
+		base = strings.TrimRight(base[:maxFileNameLength], "._")
+	}
+	if base == "" {
+		return ""
+	}
+	return base + ext
+}
+
+// fileExtension returns extension of the name, long one isn't treated as extension.
+func fileExtension(name string) string {
+	ext := path.Ext(name)
+	if ext == "." || len(ext) > maxExtensionLength {
+		return ""
+	}
+	return ext
+}
+
+// contentTypeExtension returns extension of the media type, empty string if it is unknown.
+func contentTypeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaExtensions[mediaType]
+}
+
+// outputPath returns path of the file in the output dir. Error is returned if name isn't a plain
+// file name, so the file can't be written outside of the dir.
+func (s *Service) outputPath(name string) (string, error) {
+	dir, err := filepath.Abs(s.cfg.OutputDir)
+	if err != nil {
+		return "", err
+	}
+	ret := filepath.Join(dir, name)
+	if filepath.Dir(ret) != dir || filepath.Base(ret) != name {
+		return "", fmt.Errorf("file name %q escapes output dir %q", name, dir)
+	}
+	return ret, nil
+}
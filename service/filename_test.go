@@ -0,0 +1,70 @@
+package service
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dk13danger/media-service/config"
+)
+
+func TestOutputFileName(t *testing.T) {
+	tests := []struct {
+		url                string
+		contentDisposition string
+		contentType        string
+		name               string
+	}{
+		{"http://host/a/movie.mp4", "", "video/mp4", "movie.mp4"},
+		{"http://host/a/movie.mp4?x=1#f", "", "", "movie.mp4"},
+		{"http://host/a/b/", "", "video/webm", "b.webm"},
+		{"http://host/", "", "video/x-matroska", "file.mkv"},
+		{"http://host/", "", "", "file"},
+		{"http://host/x", "", "text/html", "x"},
+		{"http://host/x", "", "Video/MP4; codecs=avc1", "x.mp4"},
+		{"http://host/watch", `attachment; filename="../../evil name.MOV"`, "video/mp4", "evil_name.MOV"},
+		{"http://host/watch", `attachment; filename=".."`, "video/mp4", "watch.mp4"},
+		{"http://host/watch", `attachment; filename*=invalid`, "", "watch"},
+		// Encoded separators and dots can't escape the output dir.
+		{"http://host/%2e%2e", "", "video/mp4", "file.mp4"},
+		{"http://host/a%2F..%2F..%2Fetc%2Fpasswd", "", "", "passwd"},
+		{"http://host/..%5C..%5Cwin.ini", "", "", "win.ini"},
+		{"http://host/.hidden", "", "", "file"},
+		{"http://host/.a.b", "", "", "a.b"},
+		{"http://host/x.mp4.", "", "", "x.mp4"},
+		// Non-ASCII characters are dropped.
+		{"http://host/Привет мир.mp4", "", "video/mp4", "file.mp4"},
+		{"http://host/Привет_x.mp4", "", "", "x.mp4"},
+		// Long extension is part of the name.
+		{"http://host/x.y.verylongextension", "", "video/mp4", "x.y.verylongextension.mp4"},
+		{"http://host/" + strings.Repeat("a", 200) + ".mp4", "", "", strings.Repeat("a", maxFileNameLength) + ".mp4"},
+	}
+	for _, test := range tests {
+		response := &http.Response{Header: http.Header{}}
+		response.Header.Set("Content-Disposition", test.contentDisposition)
+		response.Header.Set("Content-Type", test.contentType)
+		if name := outputFileName(test.url, response); name != test.name {
+			t.Errorf("%q (%q, %q): expected %q, got %q", test.url, test.contentDisposition, test.contentType, test.name, name)
+		}
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	s := &Service{cfg: &config.Service{OutputDir: "/tmp/out"}}
+	for _, name := range []string{"", ".", "..", "../x", "a/b", "a/../b"} {
+		if path, err := s.outputPath(name); err == nil {
+			t.Errorf("%q: expected error, got %q", name, path)
+		}
+	}
+	if path, err := s.outputPath("1-a.mp4"); err != nil || path != filepath.FromSlash("/tmp/out/1-a.mp4") {
+		t.Errorf("expected /tmp/out/1-a.mp4, got %q, %v", path, err)
+	}
+}
+
+func TestBlobKey(t *testing.T) {
+	task := &Task{Id: 7, Hash: "d41d8cd98f00b204e9800998ecf8427e", HashAlgo: "md5"}
+	if key := blobKey(task, "7-movie.mp4"); key != "md5/d41d8cd98f00b204e9800998ecf8427e-7-movie.mp4" {
+		t.Errorf("unexpected key %q", key)
+	}
+}
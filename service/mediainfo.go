@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dk13danger/media-service/storage"
+)
+
+const (
+	CODEC_TYPE_VIDEO = "video"
+	CODEC_TYPE_AUDIO = "audio"
+)
+
+// MediaInfo describes media container and its streams.
+// Durations are in seconds, bit rates are in bits per second.
+type MediaInfo struct {
+	Container string       `json:"container"`
+	Duration  float64      `json:"duration"`
+	Size      int64        `json:"size"`
+	BitRate   int64        `json:"bit_rate"`
+	Streams   []StreamInfo `json:"streams"`
+}
+
+type StreamInfo struct {
+	Index         int     `json:"index"`
+	CodecType     string  `json:"codec_type"`
+	CodecName     string  `json:"codec_name"`
+	Profile       string  `json:"profile,omitempty"`
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	PixelFormat   string  `json:"pixel_format,omitempty"`
+	FrameRate     float64 `json:"frame_rate,omitempty"`
+	SampleRate    int     `json:"sample_rate,omitempty"`
+	Channels      int     `json:"channels,omitempty"`
+	ChannelLayout string  `json:"channel_layout,omitempty"`
+	BitRate       int64   `json:"bit_rate,omitempty"`
+	Duration      float64 `json:"duration,omitempty"`
+	Language      string  `json:"language,omitempty"`
+}
+
+// probeOutput is the output of `ffprobe -of json -show_format -show_streams`.
+// ffprobe prints most of the numbers as strings.
+type probeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		Index         int               `json:"index"`
+		CodecType     string            `json:"codec_type"`
+		CodecName     string            `json:"codec_name"`
+		Profile       string            `json:"profile"`
+		Width         int               `json:"width"`
+		Height        int               `json:"height"`
+		PixFmt        string            `json:"pix_fmt"`
+		AvgFrameRate  string            `json:"avg_frame_rate"`
+		RFrameRate    string            `json:"r_frame_rate"`
+		SampleRate    string            `json:"sample_rate"`
+		Channels      int               `json:"channels"`
+		ChannelLayout string            `json:"channel_layout"`
+		BitRate       string            `json:"bit_rate"`
+		Duration      string            `json:"duration"`
+		Tags          map[string]string `json:"tags"`
+	} `json:"streams"`
+}
+
+func parseMediaInfo(output []byte) (*MediaInfo, error) {
+	probe := &probeOutput{}
+	if err := json.Unmarshal(output, probe); err != nil {
+		return nil, fmt.Errorf("can't parse ffprobe output: %v", err)
+	}
+	if len(probe.Streams) == 0 {
+		return nil, fmt.Errorf("no media streams found")
+	}
+
+	info := &MediaInfo{
+		Container: probe.Format.FormatName,
+		Duration:  parseFloat(probe.Format.Duration),
+		Size:      parseInt(probe.Format.Size),
+		BitRate:   parseInt(probe.Format.BitRate),
+		Streams:   make([]StreamInfo, 0, len(probe.Streams)),
+	}
+	for _, s := range probe.Streams {
+		frameRate := parseFrameRate(s.AvgFrameRate)
+		if frameRate == 0 {
+			frameRate = parseFrameRate(s.RFrameRate)
+		}
+		info.Streams = append(info.Streams, StreamInfo{
+			Index:         s.Index,
+			CodecType:     s.CodecType,
+			CodecName:     s.CodecName,
+			Profile:       s.Profile,
+			Width:         s.Width,
+			Height:        s.Height,
+			PixelFormat:   s.PixFmt,
+			FrameRate:     frameRate,
+			SampleRate:    int(parseInt(s.SampleRate)),
+			Channels:      s.Channels,
+			ChannelLayout: s.ChannelLayout,
+			BitRate:       parseInt(s.BitRate),
+			Duration:      parseFloat(s.Duration),
+			Language:      s.Tags["language"],
+		})
+	}
+	return info, nil
+}
+
+// VideoStream returns the first video stream or nil for audio-only files.
+func (m *MediaInfo) VideoStream() *StreamInfo {
+	for i := range m.Streams {
+		if m.Streams[i].CodecType == CODEC_TYPE_VIDEO {
+			return &m.Streams[i]
+		}
+	}
+	return nil
+}
+
+// Resolution returns resolution of the video stream in form of "<width>x<height>".
+func (m *MediaInfo) Resolution() string {
+	video := m.VideoStream()
+	if video == nil {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", video.Width, video.Height)
+}
+
+// VideoBitRate returns bit rate of the video stream, or bit rate of the whole file
+// if the stream doesn't have it.
+func (m *MediaInfo) VideoBitRate() string {
+	if video := m.VideoStream(); video != nil && video.BitRate > 0 {
+		return strconv.FormatInt(video.BitRate, 10)
+	}
+	if m.BitRate > 0 {
+		return strconv.FormatInt(m.BitRate, 10)
+	}
+	return ""
+}
+
+func (m *MediaInfo) streamModels(fileId int) []storage.MediaStreamModel {
+	ret := make([]storage.MediaStreamModel, 0, len(m.Streams))
+	for _, s := range m.Streams {
+		ret = append(ret, storage.MediaStreamModel{
+			FileId:    fileId,
+			Index:     s.Index,
+			CodecType: s.CodecType,
+			CodecName: s.CodecName,
+			Width:     s.Width,
+			Height:    s.Height,
+			BitRate:   s.BitRate,
+			Duration:  s.Duration,
+			Language:  s.Language,
+		})
+	}
+	return ret
+}
+
+func parseInt(value string) int64 {
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
+func parseFloat(value string) float64 {
+	n, _ := strconv.ParseFloat(value, 64)
+	return n
+}
+
+// parseFrameRate parses frame rate in form of "30000/1001".
+func parseFrameRate(value string) float64 {
+	tokens := strings.SplitN(value, "/", 2)
+	if len(tokens) != 2 {
+		return parseFloat(value)
+	}
+	denominator := parseFloat(tokens[1])
+	if denominator == 0 {
+		return 0
+	}
+	return parseFloat(tokens[0]) / denominator
+}
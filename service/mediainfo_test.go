@@ -0,0 +1,124 @@
+package service
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseMediaInfo(t *testing.T) {
+	tests := []struct {
+		file       string
+		info       *MediaInfo
+		resolution string
+		bitRate    string
+	}{
+		{
+			file: "testdata/ffprobe_video.json",
+			info: &MediaInfo{
+				Container: "mov,mp4,m4a,3gp,3g2,mj2",
+				Duration:  60.06,
+				Size:      38534629,
+				BitRate:   5132807,
+				Streams: []StreamInfo{
+					{
+						Index:       0,
+						CodecType:   CODEC_TYPE_VIDEO,
+						CodecName:   "h264",
+						Profile:     "High",
+						Width:       1920,
+						Height:      1080,
+						PixelFormat: "yuv420p",
+						FrameRate:   30000.0 / 1001,
+						BitRate:     4996426,
+						Duration:    60.06,
+						Language:    "und",
+					},
+					{
+						Index:         1,
+						CodecType:     CODEC_TYPE_AUDIO,
+						CodecName:     "aac",
+						Profile:       "LC",
+						SampleRate:    48000,
+						Channels:      2,
+						ChannelLayout: "stereo",
+						BitRate:       128002,
+						Duration:      60.06,
+						Language:      "eng",
+					},
+				},
+			},
+			resolution: "1920x1080",
+			bitRate:    "4996426",
+		},
+		{
+			file: "testdata/ffprobe_audio.json",
+			info: &MediaInfo{
+				Container: "mp3",
+				Duration:  180,
+				Size:      7201253,
+				BitRate:   320055,
+				Streams: []StreamInfo{
+					{
+						Index:         0,
+						CodecType:     CODEC_TYPE_AUDIO,
+						CodecName:     "mp3",
+						SampleRate:    44100,
+						Channels:      2,
+						ChannelLayout: "stereo",
+						BitRate:       320000,
+						Duration:      180,
+					},
+				},
+			},
+			// Audio-only file has no resolution, bit rate of the whole file is used.
+			resolution: "",
+			bitRate:    "320055",
+		},
+	}
+	for _, test := range tests {
+		output, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := parseMediaInfo(output)
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		if !reflect.DeepEqual(info, test.info) {
+			t.Errorf("%s: media info mismatch:\n%+v\n%+v", test.file, info, test.info)
+		}
+		if resolution := info.Resolution(); resolution != test.resolution {
+			t.Errorf("%s: resolution %q != %q", test.file, resolution, test.resolution)
+		}
+		if bitRate := info.VideoBitRate(); bitRate != test.bitRate {
+			t.Errorf("%s: bit rate %q != %q", test.file, bitRate, test.bitRate)
+		}
+	}
+}
+
+func TestParseMediaInfoErrors(t *testing.T) {
+	for _, output := range []string{
+		"",
+		"not json",
+		`{"streams": [], "format": {"format_name": "mp4"}}`,
+	} {
+		if info, err := parseMediaInfo([]byte(output)); err == nil {
+			t.Errorf("%q: error expected, got %+v", output, info)
+		}
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	for value, expected := range map[string]float64{
+		"25/1":       25,
+		"30000/1001": 30000.0 / 1001,
+		"0/0":        0,
+		"24":         24,
+		"":           0,
+	} {
+		if rate := parseFrameRate(value); rate != expected {
+			t.Errorf("%q: %v != %v", value, rate, expected)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/config"
+	"github.com/dk13danger/media-service/storage"
+)
+
+// SignatureHeader contains HMAC-SHA256 of the callback body signed by notifier secret.
+const SignatureHeader = "X-Media-Service-Signature"
+
+// defaultNotifierPollInterval is used when poll interval isn't configured.
+const defaultNotifierPollInterval = 5
+
+// defaultNotifierTimeout is used when timeout isn't configured, so delivery can't outlive its lease.
+const defaultNotifierTimeout = 30
+
+// Notifier delivers task final statuses to the callback urls.
+// Deliveries are stored before sending, so they are not lost across restarts.
+// Each delivery is leased before sending, so it isn't sent twice by notifiers of service replicas.
+type Notifier struct {
+	logger  *logrus.Logger
+	storage storage.Storager
+	cfg     *config.Notifier
+	client  *http.Client
+	owner   string
+	wg      *sync.WaitGroup
+	wakeup  chan struct{}
+	done    chan struct{}
+}
+
+// CallbackPayload is sent to the callback url when task is completed or failed.
+type CallbackPayload struct {
+	TaskId     int    `json:"task_id"`
+	Url        string `json:"url"`
+	Hash       string `json:"hash"`
+	HashAlgo   string `json:"hash_algo"`
+	Status     string `json:"status"`
+	BitRate    string `json:"bitrate"`
+	Resolution string `json:"resolution"`
+	Location   string `json:"location"`
+	Message    string `json:"message"`
+}
+
+func NewNotifier(
+	storage storage.Storager,
+	logger *logrus.Logger,
+	cfg *config.Notifier,
+) *Notifier {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultNotifierPollInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultNotifierTimeout
+	}
+	return &Notifier{
+		logger:  logger,
+		storage: storage,
+		cfg:     cfg,
+		client:  &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		owner:   processOwner(),
+		wg:      &sync.WaitGroup{},
+		wakeup:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// Run starts delivery loop. Pending deliveries left after restart are sent first.
+func (n *Notifier) Run() {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		ticker := time.NewTicker(time.Duration(n.cfg.PollInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			n.deliverPending()
+			select {
+			case <-ticker.C:
+			case <-n.wakeup:
+			case <-n.done:
+				n.logger.Debug("Stop notifier")
+				return
+			}
+		}
+	}()
+}
+
+func (n *Notifier) Stop() {
+	close(n.done)
+	n.wg.Wait()
+}
+
+// Notify stores delivery of the task final status if task has callback url.
+func (n *Notifier) Notify(fileId, status int, msg string) error {
+	file, err := n.storage.SelectFileById(fileId)
+	if err != nil {
+		return fmt.Errorf("error while selecting file %d: %v", fileId, err)
+	}
+	if file == nil || file.CallbackUrl == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(&CallbackPayload{
+		TaskId:     file.Id,
+		Url:        file.Url,
+		Hash:       file.Hash,
+		HashAlgo:   file.HashAlgo,
+		Status:     storage.StatusName(status),
+		BitRate:    file.BitRate,
+		Resolution: file.Resolution,
+		Location:   file.Location,
+		Message:    msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = n.storage.InsertCallback(&storage.CallbackModel{
+		FileId:        file.Id,
+		Url:           file.CallbackUrl,
+		Payload:       string(payload),
+		Status:        storage.CALLBACK_PENDING,
+		NextAttemptAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("error while inserting callback of file %d: %v", fileId, err)
+	}
+
+	select {
+	case n.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deliverPending claims and delivers due callbacks one by one until there are none left.
+// Lease outlives delivery (it is limited by timeout), so slow delivery isn't claimed again by the next poll.
+func (n *Notifier) deliverPending() {
+	for {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+
+		now := time.Now()
+		leaseUntil := now.Add(time.Duration(n.cfg.Timeout+n.cfg.PollInterval) * time.Second).Unix()
+		c, err := n.storage.ClaimCallback(n.owner, now.Unix(), leaseUntil)
+		if err != nil {
+			n.logger.Errorf("Can't claim pending callback: %v", err)
+			return
+		}
+		if c == nil {
+			return
+		}
+		n.deliver(c)
+	}
+}
+
+func (n *Notifier) deliver(c *storage.CallbackModel) {
+	c.Attempts++
+	if err := n.post(c); err != nil {
+		c.LastError = err.Error()
+		if c.Attempts >= n.cfg.Attempts {
+			c.Status = storage.CALLBACK_FAILED
+			n.logger.Errorf("Callback of file %d to %q failed, all attempts are spent: %v", c.FileId, c.Url, err)
+		} else {
+			c.NextAttemptAt = time.Now().Add(n.backoff(c.Attempts)).Unix()
+			n.logger.Errorf("Callback of file %d to %q failed (attempt: #%d): %v", c.FileId, c.Url, c.Attempts, err)
+		}
+	} else {
+		c.Status = storage.CALLBACK_DELIVERED
+		c.LastError = ""
+		n.logger.Infof("Callback of file %d delivered to %q", c.FileId, c.Url)
+	}
+
+	if _, err := n.storage.UpdateCallback(c); err != nil {
+		n.logger.Errorf("Can't update callback %d: %v", c.Id, err)
+	}
+}
+
+// backoff doubles delay after each failed attempt up to max backoff.
+func (n *Notifier) backoff(attempts int) time.Duration {
+	delay := time.Duration(n.cfg.Backoff) * time.Second
+	max := time.Duration(n.cfg.MaxBackoff) * time.Second
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (n *Notifier) post(c *storage.CallbackModel) error {
+	request, err := http.NewRequest(http.MethodPost, c.Url, bytes.NewBufferString(c.Payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, "sha256="+n.sign(c.Payload))
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
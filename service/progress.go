@@ -0,0 +1,94 @@
+package service
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of the task downloading progress.
+// Total and Eta are equal to -1 if origin didn't send content length.
+type Progress struct {
+	Downloaded int64   `json:"downloaded"`
+	Total      int64   `json:"total"`
+	Speed      float64 `json:"speed"`
+	Eta        float64 `json:"eta"`
+}
+
+// progressReader counts bytes read from the response body of the in-flight task.
+type progressReader struct {
+	// counter is accessed atomically, so it must be 64-bit aligned.
+	counter int64
+	reader  io.Reader
+	start   time.Time
+	offset  int64
+	total   int64
+}
+
+func newProgressReader(reader io.Reader, offset, total int64) *progressReader {
+	return &progressReader{
+		reader: reader,
+		start:  time.Now(),
+		offset: offset,
+		total:  total,
+	}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.counter, int64(n))
+	return n, err
+}
+
+// Progress calculates speed only by bytes downloaded within current attempt,
+// resumed bytes are only counted as downloaded.
+func (r *progressReader) Progress() Progress {
+	counter := atomic.LoadInt64(&r.counter)
+	p := Progress{
+		Downloaded: r.offset + counter,
+		Total:      r.total,
+		Eta:        -1,
+	}
+	if elapsed := time.Since(r.start).Seconds(); elapsed > 0 {
+		p.Speed = float64(counter) / elapsed
+	}
+	if r.total >= 0 && p.Speed > 0 {
+		p.Eta = float64(r.total-p.Downloaded) / p.Speed
+	}
+	return p
+}
+
+// progressManager keeps progress of in-flight tasks in memory.
+type progressManager struct {
+	mu      sync.RWMutex
+	readers map[int]*progressReader
+}
+
+func newProgressManager() *progressManager {
+	return &progressManager{
+		readers: make(map[int]*progressReader),
+	}
+}
+
+func (m *progressManager) Track(fileId int, reader *progressReader) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readers[fileId] = reader
+}
+
+func (m *progressManager) Untrack(fileId int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.readers, fileId)
+}
+
+func (m *progressManager) Get(fileId int) (Progress, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	reader, ok := m.readers[fileId]
+	if !ok {
+		return Progress{}, false
+	}
+	return reader.Progress(), true
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dk13danger/media-service/config"
+	"github.com/dk13danger/media-service/storage"
+)
+
+// tokenBucket allows rate tokens per second with bursts up to burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// TryTake takes one token if it is available, otherwise returns delay till it is.
+func (b *tokenBucket) TryTake() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Tokens returns count of available tokens without taking them.
+func (b *tokenBucket) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	return b.tokens
+}
+
+// Reserve takes n tokens in advance and returns delay after which they are available.
+func (b *tokenBucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Burst returns max count of tokens taken at once.
+func (b *tokenBucket) Burst() int {
+	return int(b.burst)
+}
+
+// limiter limits count of bytes read per second.
+type limiter interface {
+	// Reserve takes n bytes in advance and returns delay after which they are allowed.
+	Reserve(n int) time.Duration
+	// Burst returns max count of bytes allowed at once, not positive means unlimited.
+	Burst() int
+}
+
+// hostLimit keeps state of downloads from one host.
+type hostLimit struct {
+	cfg         config.HostLimit
+	connections int
+	requests    *tokenBucket
+	bandwidth   *tokenBucket
+}
+
+// hostLimiter limits downloads by hosts of their urls. Limits aren't shared by service replicas.
+type hostLimiter struct {
+	mu       sync.Mutex
+	defaults config.HostLimit
+	custom   map[string]config.HostLimit
+	hosts    map[string]*hostLimit
+}
+
+func newHostLimiter(defaults config.HostLimit, custom map[string]config.HostLimit) *hostLimiter {
+	return &hostLimiter{
+		defaults: defaults,
+		custom:   custom,
+		hosts:    make(map[string]*hostLimit),
+	}
+}
+
+func (l *hostLimiter) host(rawUrl string) *hostLimit {
+	name := storage.UrlHost(rawUrl)
+	if h, ok := l.hosts[name]; ok {
+		return h
+	}
+	cfg, ok := l.custom[name]
+	if !ok {
+		cfg = l.defaults
+	}
+	h := &hostLimit{cfg: cfg}
+	if cfg.RequestsPerSecond > 0 {
+		burst := cfg.RequestsPerSecond
+		if burst < 1 {
+			burst = 1
+		}
+		h.requests = newTokenBucket(cfg.RequestsPerSecond, burst)
+	}
+	if cfg.Bandwidth > 0 {
+		h.bandwidth = newTokenBucket(float64(cfg.Bandwidth), float64(cfg.Bandwidth))
+	}
+	l.hosts[name] = h
+	return h
+}
+
+// Acquire takes connection to the host of the url. Returns false and delay after which
+// the host is expected to accept the next download, if host limits are exceeded.
+// Acquired connection must be released.
+func (l *hostLimiter) Acquire(rawUrl string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.host(rawUrl)
+	if h.cfg.MaxConnections > 0 && h.connections >= h.cfg.MaxConnections {
+		return false, time.Second
+	}
+	if h.requests != nil {
+		if ok, delay := h.requests.TryTake(); !ok {
+			return false, delay
+		}
+	}
+	h.connections++
+	return true, 0
+}
+
+func (l *hostLimiter) Release(rawUrl string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h := l.host(rawUrl); h.connections > 0 {
+		h.connections--
+	}
+}
+
+// Saturated returns hosts which can't accept the next download now, so their jobs aren't claimed.
+// State of idle hosts (no downloads and full buckets) is the same as of new ones, so it is dropped.
+func (l *hostLimiter) Saturated() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ret := make([]string, 0)
+	for name, h := range l.hosts {
+		if h.connections == 0 && isFull(h.requests) && isFull(h.bandwidth) {
+			delete(l.hosts, name)
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		if h.cfg.MaxConnections > 0 && h.connections >= h.cfg.MaxConnections || h.requests != nil && h.requests.Tokens() < 1 {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// isFull reports whether bucket has all its tokens, nil bucket is full.
+func isFull(b *tokenBucket) bool {
+	return b == nil || b.Tokens() >= b.burst
+}
+
+// Bandwidth returns bandwidth limiter of the host of the url, nil if bandwidth isn't limited.
+func (l *hostLimiter) Bandwidth(rawUrl string) limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bandwidth := l.host(rawUrl).bandwidth; bandwidth != nil {
+		return bandwidth
+	}
+	return nil
+}
+
+// throttledReader waits after each read until read bytes are allowed by all limiters.
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []limiter
+}
+
+// newThrottledReader wraps reader by not nil limiters.
+func newThrottledReader(ctx context.Context, reader io.Reader, limiters ...limiter) io.Reader {
+	r := &throttledReader{ctx: ctx, reader: reader}
+	for _, l := range limiters {
+		if l != nil {
+			r.limiters = append(r.limiters, l)
+		}
+	}
+	if len(r.limiters) == 0 {
+		return reader
+	}
+	return r
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// Reads are not larger than burst, so one read doesn't exceed the limit for long.
+	for _, l := range r.limiters {
+		if burst := l.Burst(); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := r.reader.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	var delay time.Duration
+	for _, l := range r.limiters {
+		if d := l.Reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return n, err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.ctx.Done():
+		return n, r.ctx.Err()
+	}
+	return n, err
+}
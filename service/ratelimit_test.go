@@ -0,0 +1,44 @@
+package service
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dk13danger/media-service/config"
+)
+
+func TestHostLimiterSaturated(t *testing.T) {
+	l := newHostLimiter(config.HostLimit{MaxConnections: 1}, map[string]config.HostLimit{
+		"rated": {RequestsPerSecond: 0.001},
+	})
+
+	if ok, _ := l.Acquire("http://Busy:8080/a.mp4"); !ok {
+		t.Fatal("first connection to the host isn't acquired")
+	}
+	if ok, _ := l.Acquire("http://rated/a.mp4"); !ok {
+		t.Fatal("first request to the host isn't acquired")
+	}
+	l.Release("http://rated/a.mp4")
+	if ok, _ := l.Acquire("http://idle/a.mp4"); !ok {
+		t.Fatal("first connection to the host isn't acquired")
+	}
+	l.Release("http://idle/a.mp4")
+
+	saturated := l.Saturated()
+	sort.Strings(saturated)
+	if want := []string{"busy", "rated"}; !reflect.DeepEqual(saturated, want) {
+		t.Fatalf("Saturated() = %v; want %v", saturated, want)
+	}
+	if _, ok := l.hosts["idle"]; ok {
+		t.Fatal("idle host isn't evicted")
+	}
+
+	l.Release("http://busy/a.mp4")
+	if saturated := l.Saturated(); !reflect.DeepEqual(saturated, []string{"rated"}) {
+		t.Fatalf("Saturated() after release = %v; want [rated]", saturated)
+	}
+	if len(l.hosts) != 1 {
+		t.Fatalf("hosts = %v; want only rated host", l.hosts)
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// resumeInfo describes which version of the remote file the partial local file belongs to.
+// It's stored near the partial file, so downloading can be resumed after retry or service restart.
+type resumeInfo struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// newResumeInfo returns nil if origin doesn't support range requests
+// or doesn't provide strong validator for the file.
+func newResumeInfo(response *http.Response) *resumeInfo {
+	if response.Header.Get("Accept-Ranges") != "bytes" {
+		return nil
+	}
+	info := &resumeInfo{
+		LastModified: response.Header.Get("Last-Modified"),
+	}
+	// Weak entity tags can't be used within If-Range header.
+	if etag := response.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		info.ETag = etag
+	}
+	if info.validator() == "" {
+		return nil
+	}
+	return info
+}
+
+func (i *resumeInfo) validator() string {
+	if i.ETag != "" {
+		return i.ETag
+	}
+	return i.LastModified
+}
+
+// checkPartialResponse makes sure that origin sent the rest of the same file we have.
+func (i *resumeInfo) checkPartialResponse(response *http.Response, offset int64) error {
+	if i.ETag != "" && response.Header.Get("ETag") != i.ETag {
+		return fmt.Errorf("etag mismatch: %q != %q", response.Header.Get("ETag"), i.ETag)
+	}
+	if i.ETag == "" && response.Header.Get("Last-Modified") != i.LastModified {
+		return fmt.Errorf("last modified mismatch: %q != %q", response.Header.Get("Last-Modified"), i.LastModified)
+	}
+	var start, end int64
+	contentRange := response.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end); err != nil {
+		return fmt.Errorf("invalid content range %q: %v", contentRange, err)
+	}
+	if start != offset {
+		return fmt.Errorf("content range %q doesn't start from offset %d", contentRange, offset)
+	}
+	return nil
+}
+
+func resumeInfoPath(filePath string) string {
+	return filePath + ".resume"
+}
+
+func readResumeInfo(filePath string) *resumeInfo {
+	content, err := ioutil.ReadFile(resumeInfoPath(filePath))
+	if err != nil {
+		return nil
+	}
+	info := &resumeInfo{}
+	if err := json.Unmarshal(content, info); err != nil || info.validator() == "" {
+		return nil
+	}
+	return info
+}
+
+func writeResumeInfo(filePath string, info *resumeInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(resumeInfoPath(filePath), content, 0644)
+}
+
+func removeResumeInfo(filePath string) {
+	os.Remove(resumeInfoPath(filePath))
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dk13danger/media-service/config"
+)
+
+// Kinds of download errors, each one is retried by its own policy.
+const (
+	ERROR_DNS          = "dns"
+	ERROR_CONNECTION   = "connection"
+	ERROR_SERVER       = "server"
+	ERROR_RATE_LIMITED = "rate_limited"
+	ERROR_NOT_FOUND    = "not_found"
+	ERROR_REJECTED     = "rejected"
+	ERROR_CHECKSUM     = "checksum"
+	ERROR_DISK_FULL    = "disk_full"
+	ERROR_OTHER        = "other"
+)
+
+// defaultRetries are used for error kinds (or fields) which aren't configured.
+// Zero attempts means service attempts.
+var defaultRetries = map[string]config.Retry{
+	ERROR_DNS:          {Backoff: 10, MaxBackoff: 300, Jitter: 0.2},
+	ERROR_CONNECTION:   {Backoff: 2, MaxBackoff: 120, Jitter: 0.2},
+	ERROR_SERVER:       {Backoff: 5, MaxBackoff: 300, Jitter: 0.2},
+	ERROR_RATE_LIMITED: {Backoff: 30, MaxBackoff: 900, Jitter: 0.2},
+	ERROR_NOT_FOUND:    {Attempts: 1},
+	ERROR_REJECTED:     {Attempts: 1},
+	ERROR_CHECKSUM:     {Attempts: 2, Backoff: 1, MaxBackoff: 1},
+	ERROR_DISK_FULL:    {Backoff: 60, MaxBackoff: 600, Jitter: 0.2},
+	ERROR_OTHER:        {Backoff: 1, MaxBackoff: 60, Jitter: 0.2},
+}
+
+// httpStatusError is returned when origin responds with unexpected status.
+// RetryAfter is the delay asked by origin (`Retry-After` header), zero if not given.
+type httpStatusError struct {
+	url        string
+	status     string
+	statusCode int
+	retryAfter time.Duration
+}
+
+func newHttpStatusError(url string, response *http.Response) *httpStatusError {
+	return &httpStatusError{
+		url:        url,
+		status:     response.Status,
+		statusCode: response.StatusCode,
+		retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+	}
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status from url %q: %s", e.url, e.status)
+}
+
+// retryError is returned when failed task has to be retried after delay.
+type retryError struct {
+	delay time.Duration
+	err   error
+}
+
+func (e *retryError) Error() string {
+	return fmt.Sprintf("task will be retried in %v: %v", e.delay, e.err)
+}
+
+// failedError is returned when task is failed: its final status is logged, so its job is done.
+type failedError struct {
+	message string
+}
+
+func (e *failedError) Error() string {
+	return e.message
+}
+
+// taskError keeps the cause of the failed task step, so it can be classified.
+type taskError struct {
+	message string
+	err     error
+}
+
+func (e *taskError) Error() string {
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+// storeError is returned when downloaded file can't be put into the blob store.
+type storeError struct {
+	err error
+}
+
+func (e *storeError) Error() string {
+	return e.err.Error()
+}
+
+// classifyError returns kind of the download error.
+func classifyError(err error) string {
+	for err != nil {
+		switch e := err.(type) {
+		case *checksumError:
+			return ERROR_CHECKSUM
+		case *rejectedError:
+			return ERROR_REJECTED
+		case *httpStatusError:
+			switch {
+			case e.statusCode == http.StatusTooManyRequests:
+				return ERROR_RATE_LIMITED
+			case e.statusCode == http.StatusNotFound || e.statusCode == http.StatusGone:
+				return ERROR_NOT_FOUND
+			case e.statusCode >= 500:
+				return ERROR_SERVER
+			}
+			return ERROR_OTHER
+		case *net.DNSError:
+			return ERROR_DNS
+		case syscall.Errno:
+			switch e {
+			case syscall.ENOSPC, syscall.EDQUOT:
+				return ERROR_DISK_FULL
+			case syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE,
+				syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+				return ERROR_CONNECTION
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ERROR_CONNECTION
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return ERROR_CONNECTION
+		}
+		err = errorCause(err)
+	}
+	return ERROR_OTHER
+}
+
+// errorCause returns error wrapped by err or nil.
+func errorCause(err error) error {
+	switch e := err.(type) {
+	case *taskError:
+		return e.err
+	case *storeError:
+		return e.err
+	case *url.Error:
+		return e.Err
+	case *net.OpError:
+		return e.Err
+	case *os.PathError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	}
+	return nil
+}
+
+// retryPolicy returns policy of the error kind: configured fields override default ones.
+func (s *Service) retryPolicy(kind string) config.Retry {
+	policy, ok := defaultRetries[kind]
+	if !ok {
+		policy = defaultRetries[ERROR_OTHER]
+	}
+	if custom, ok := s.cfg.Retries[kind]; ok {
+		if custom.Attempts > 0 {
+			policy.Attempts = custom.Attempts
+		}
+		if custom.Backoff > 0 {
+			policy.Backoff = custom.Backoff
+		}
+		if custom.MaxBackoff > 0 {
+			policy.MaxBackoff = custom.MaxBackoff
+		}
+		if custom.Jitter > 0 {
+			policy.Jitter = custom.Jitter
+		}
+	}
+	if policy.Attempts <= 0 {
+		policy.Attempts = s.cfg.Attempts
+	}
+	if policy.MaxBackoff < policy.Backoff {
+		policy.MaxBackoff = policy.Backoff
+	}
+	return policy
+}
+
+// retryDelay doubles backoff after each failed attempt up to max backoff and randomizes it by jitter,
+// so tasks failed at once aren't retried at once. Delay asked by origin is respected.
+func retryDelay(policy config.Retry, attempt int, err error) time.Duration {
+	delay := time.Duration(policy.Backoff) * time.Second
+	max := time.Duration(policy.MaxBackoff) * time.Second
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if policy.Jitter > 0 {
+		delay += time.Duration(float64(delay) * policy.Jitter * (2*rand.Float64() - 1))
+	}
+
+	for ; err != nil; err = errorCause(err) {
+		if e, ok := err.(*httpStatusError); ok && e.retryAfter > delay {
+			return e.retryAfter
+		}
+	}
+	return delay
+}
+
+// parseRetryAfter parses `Retry-After` header given either by seconds or by http date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/config"
+	"github.com/dk13danger/media-service/storage"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{&url.Error{Op: "Get", URL: "http://a", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}}, ERROR_DNS},
+		{&url.Error{Op: "Get", URL: "http://a", Err: &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}}, ERROR_CONNECTION},
+		{&taskError{"error while reading body", io.ErrUnexpectedEOF}, ERROR_CONNECTION},
+		{&taskError{"error while reading body", &idleTimeoutError{time.Second}}, ERROR_CONNECTION},
+		{&httpStatusError{statusCode: http.StatusServiceUnavailable}, ERROR_SERVER},
+		{&httpStatusError{statusCode: http.StatusTooManyRequests}, ERROR_RATE_LIMITED},
+		{&httpStatusError{statusCode: http.StatusNotFound}, ERROR_NOT_FOUND},
+		{&httpStatusError{statusCode: http.StatusGone}, ERROR_NOT_FOUND},
+		{&httpStatusError{statusCode: http.StatusForbidden}, ERROR_OTHER},
+		{&rejectedError{"content type is not allowed"}, ERROR_REJECTED},
+		{&checksumError{"a", "b"}, ERROR_CHECKSUM},
+		{&taskError{"error while writing file", &os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}}, ERROR_DISK_FULL},
+		{&storeError{&os.PathError{Op: "rename", Path: "f", Err: syscall.EDQUOT}}, ERROR_DISK_FULL},
+		{errors.New("unknown"), ERROR_OTHER},
+	}
+	for i, test := range tests {
+		if kind := classifyError(test.err); kind != test.kind {
+			t.Errorf("#%d %v: expected %q kind, got %q", i, test.err, test.kind, kind)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	s := &Service{cfg: &config.Service{
+		Attempts: 5,
+		Retries: map[string]config.Retry{
+			ERROR_SERVER:    {Attempts: 3, MaxBackoff: 1},
+			ERROR_NOT_FOUND: {Backoff: 2},
+			"unknown":       {Attempts: 7},
+		},
+	}}
+
+	tests := []struct {
+		kind   string
+		policy config.Retry
+	}{
+		{ERROR_DNS, config.Retry{Attempts: 5, Backoff: 10, MaxBackoff: 300, Jitter: 0.2}},
+		{ERROR_SERVER, config.Retry{Attempts: 3, Backoff: 5, MaxBackoff: 5, Jitter: 0.2}},
+		{ERROR_NOT_FOUND, config.Retry{Attempts: 1, Backoff: 2, MaxBackoff: 2}},
+		{"unknown", config.Retry{Attempts: 7, Backoff: 1, MaxBackoff: 60, Jitter: 0.2}},
+	}
+	for _, test := range tests {
+		if policy := s.retryPolicy(test.kind); policy != test.policy {
+			t.Errorf("%s: expected %+v, got %+v", test.kind, test.policy, policy)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := config.Retry{Backoff: 2, MaxBackoff: 10}
+	tests := []struct {
+		attempt int
+		err     error
+		delay   time.Duration
+	}{
+		{1, nil, 2 * time.Second},
+		{2, nil, 4 * time.Second},
+		{3, nil, 8 * time.Second},
+		{4, nil, 10 * time.Second},
+		{10, nil, 10 * time.Second},
+		{1, &taskError{"error", &httpStatusError{retryAfter: time.Minute}}, time.Minute},
+		{4, &httpStatusError{retryAfter: time.Second}, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if delay := retryDelay(policy, test.attempt, test.err); delay != test.delay {
+			t.Errorf("attempt %d: expected %v delay, got %v", test.attempt, test.delay, delay)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := retryDelay(policy, 1, nil); delay < time.Second || delay > 3*time.Second {
+			t.Fatalf("delay %v is out of jitter range", delay)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if delay := parseRetryAfter("120"); delay != 2*time.Minute {
+		t.Errorf("expected 2m, got %v", delay)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if delay := parseRetryAfter(date); delay < 59*time.Minute || delay > time.Hour {
+		t.Errorf("expected about 1h, got %v", delay)
+	}
+	for _, value := range []string{"", "0", "-5", "soon", "Mon, 02 Jan 2006 15:04:05 GMT"} {
+		if delay := parseRetryAfter(value); delay != 0 {
+			t.Errorf("%q: expected no delay, got %v", value, delay)
+		}
+	}
+}
+
+// TestRetryTaskSharedAttempts checks that attempts of all error kinds are counted together
+// and the limit of the kind of the last error caps the total.
+func TestRetryTaskSharedAttempts(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	store := storage.NewMemoryStorage(logger)
+	s := &Service{
+		logger:   logger,
+		storage:  store,
+		notifier: NewNotifier(store, logger, &config.Notifier{}),
+		events:   newEventBroker(),
+		cfg: &config.Service{
+			Attempts: 5,
+			Retries:  map[string]config.Retry{ERROR_SERVER: {Attempts: 3}},
+		},
+	}
+	task := &Task{Id: 1, Url: "http://host/a.mp4"}
+	dnsErr := &url.Error{Op: "Get", URL: task.Url, Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}}
+	serverErr := &httpStatusError{statusCode: http.StatusBadGateway}
+
+	tests := []struct {
+		attempt int
+		err     error
+		failed  bool
+	}{
+		{1, dnsErr, false},
+		{2, serverErr, false},
+		// Third attempt spends server attempts, though only two of them are server errors.
+		{3, serverErr, true},
+		// The same total is below dns attempts.
+		{3, dnsErr, false},
+		{5, dnsErr, true},
+	}
+	for _, test := range tests {
+		err := s.retryTask(task, test.attempt, test.err)
+		switch err.(type) {
+		case *failedError:
+			if !test.failed {
+				t.Errorf("attempt %d (%v): task is failed; want retry", test.attempt, test.err)
+			}
+		case *retryError:
+			if test.failed {
+				t.Errorf("attempt %d (%v): task is retried; want failure", test.attempt, test.err)
+			}
+		default:
+			t.Errorf("attempt %d (%v): unexpected error %v", test.attempt, test.err, err)
+		}
+	}
+}
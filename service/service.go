@@ -1,116 +1,480 @@
 package service
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
-	"regexp"
-	"strings"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/blobstore"
+	"github.com/dk13danger/media-service/checksum"
 	"github.com/dk13danger/media-service/config"
 	"github.com/dk13danger/media-service/storage"
 )
 
+// Defaults of the jobs queue config, in seconds.
+const (
+	defaultLeaseTimeout = 60
+	defaultPollInterval = 5
+)
+
 type Service struct {
 	logger       *logrus.Logger
 	cacheManager *CacheManager
+	notifier     *Notifier
+	progress     *progressManager
+	cancels      *cancelManager
+	events       *eventBroker
 	storage      storage.Storager
+	blobs        blobstore.BlobStore
+	client       *http.Client
+	limits       *hostLimiter
+	bandwidth    *bandwidthLimiter
 	cfg          *config.Service
-	regexp       *regexp.Regexp
 	wg           *sync.WaitGroup
-	inputTasks   chan *Task
+	owner        string
+	wakeup       chan struct{}
 	done         chan struct{}
 }
 
+// ErrQueueFull is returned when task can't be queued because queue capacity is exceeded.
+var ErrQueueFull = errors.New("download queue is full")
+
+// QueueStat describes jobs queue: count of waiting jobs (total and by priority name), count of them
+// delayed till the next attempt, count of jobs processed by workers (of all service replicas)
+// and queue capacity (zero means unlimited).
+type QueueStat struct {
+	Depth           int            `json:"depth"`
+	DepthByPriority map[string]int `json:"depth_by_priority"`
+	Delayed         int            `json:"delayed"`
+	InFlight        int            `json:"in_flight"`
+	Capacity        int            `json:"capacity"`
+}
+
+// checksumError is returned when downloaded file doesn't match checksum of the task.
+type checksumError struct {
+	expected string
+	actual   string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("suspusious file. Checksum from url: %q mismatch with file hash: %q", e.expected, e.actual)
+}
+
 type Task struct {
-	Url  string
-	Hash string
+	Id       int
+	Url      string
+	Hash     string
+	HashAlgo string
 }
 
 func NewService(
 	storage storage.Storager,
+	blobs blobstore.BlobStore,
 	cacheManager *CacheManager,
+	notifier *Notifier,
 	logger *logrus.Logger,
 	cfg *config.Service,
 ) *Service {
+	if cfg.LeaseTimeout <= 0 {
+		cfg.LeaseTimeout = defaultLeaseTimeout
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
 	if _, err := os.Stat(cfg.OutputDir); os.IsNotExist(err) {
 		logger.Debugf("Service dir %q not exists yet. Trying to create", cfg.OutputDir)
 		os.Mkdir(cfg.OutputDir, os.ModeDir)
 	}
+	for kind := range cfg.Retries {
+		if _, ok := defaultRetries[kind]; !ok {
+			logger.Warnf("Retry policy of unknown error kind %q is ignored", kind)
+		}
+	}
+	bandwidth, err := newBandwidthLimiter(cfg.Bandwidth)
+	if err != nil {
+		panic(fmt.Sprintf("Bandwidth config is invalid: %v", err))
+	}
 	return &Service{
 		logger:       logger,
 		cacheManager: cacheManager,
+		notifier:     notifier,
+		progress:     newProgressManager(),
+		cancels:      newCancelManager(),
+		events:       newEventBroker(),
 		storage:      storage,
+		blobs:        blobs,
+		client:       newHttpClient(&cfg.Http),
+		limits:       newHostLimiter(cfg.HostLimit, cfg.HostLimits),
+		bandwidth:    bandwidth,
 		cfg:          cfg,
-		regexp:       regexp.MustCompile(`(?m)^width=(\d+)\r*\n*height=(\d+)\r*\n*bit_rate=(\d+).*$`),
 		wg:           &sync.WaitGroup{},
-		inputTasks:   make(chan *Task, cfg.ChannelSize),
-		done:         make(chan struct{}, 1),
+		owner:        processOwner(),
+		wakeup:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// processOwner identifies this process in the jobs queue and the callbacks shared by service replicas.
+func processOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
 	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
 
-func (s *Service) Run() chan<- *Task {
+// Run starts download workers. Workers claim jobs from the queue until service is stopped.
+func (s *Service) Run() {
 	s.wg.Add(s.cfg.Workers)
 	for i := 0; i < s.cfg.Workers; i++ {
 		s.logger.Debugf("Starting download worker number: #%d", i)
+		owner := fmt.Sprintf("%s-%d", s.owner, i)
 		go func() {
-			for t := range s.inputTasks {
-				key := fmt.Sprintf("%s-%s", t.Url, t.Hash)
-				if s.cacheManager.Get(key) {
-					s.logger.Debug("File already downloading. Please wait..")
-					continue
-				}
-
-				if err := s.processTask(t, 1, key); err != nil {
-					s.logger.Errorf("Error while processing task: %v", err)
+			defer s.wg.Done()
+			ticker := time.NewTicker(time.Duration(s.cfg.PollInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				s.processJobs(owner)
+				select {
+				case <-ticker.C:
+				case <-s.wakeup:
+				case <-s.done:
+					s.logger.Debugf("Stop download worker")
+					return
 				}
 			}
-			s.logger.Debugf("Stop download worker")
-			s.wg.Done()
 		}()
 	}
-	return s.inputTasks
 }
 
+// Stop waits for in-flight jobs, queued jobs are left in the queue.
 func (s *Service) Stop() {
-	close(s.inputTasks)
-	s.logger.Debug("Service task queue closed")
+	close(s.done)
 	s.logger.Debugf("Wait while %d service workers stopping..", s.cfg.Workers)
 	s.wg.Wait()
 }
 
-func (s *Service) processTask(t *Task, attempt int, key string) error {
-	s.cacheManager.Set(key)
-	defer s.cacheManager.Remove(key)
+// Enqueue stores file (if not exists yet) and queues downloading job for it with given priority.
+// Returns id of the file or ErrQueueFull if queue is saturated.
+func (s *Service) Enqueue(file *storage.FileModel, priority int) (int, error) {
+	// Capacity is checked apart from inserting, so concurrent requests can slightly exceed it.
+	stat, err := s.Queue()
+	if err != nil {
+		return -1, err
+	}
+	if stat.Capacity > 0 && stat.Depth >= stat.Capacity {
+		return -1, ErrQueueFull
+	}
+
+	fileId, err := s.storage.EnqueueFile(file, priority, time.Now().Unix())
+	if err != nil {
+		return -1, err
+	}
+	s.wake(1)
+	return fileId, nil
+}
+
+// EnqueueBatch queues all files at once (see Enqueue) with given priority.
+// Returns id of the batch and ids of the files or ErrQueueFull if queue has no room for all of them.
+func (s *Service) EnqueueBatch(files []*storage.FileModel, priority int) (int, []int, error) {
+	stat, err := s.Queue()
+	if err != nil {
+		return -1, nil, err
+	}
+	if stat.Capacity > 0 && stat.Depth+len(files) > stat.Capacity {
+		return -1, nil, ErrQueueFull
+	}
+
+	batchId, fileIds, err := s.storage.EnqueueBatch(files, priority, time.Now().Unix())
+	if err != nil {
+		return -1, nil, err
+	}
+	s.wake(len(fileIds))
+	return batchId, fileIds, nil
+}
+
+// wake wakes up to n idle workers, so queued jobs don't wait for the next poll.
+func (s *Service) wake(n int) {
+	for i := 0; i < n && i < s.cfg.Workers; i++ {
+		select {
+		case s.wakeup <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// Queue returns current state of the jobs queue.
+func (s *Service) Queue() (QueueStat, error) {
+	count, err := s.storage.CountJobs(time.Now().Unix())
+	if err != nil {
+		return QueueStat{}, err
+	}
+	stat := QueueStat{
+		DepthByPriority: make(map[string]int),
+		Delayed:         count.Delayed,
+		InFlight:        count.Leased,
+		Capacity:        s.cfg.QueueCapacity,
+	}
+	for _, priority := range []int{storage.PRIORITY_LOW, storage.PRIORITY_NORMAL, storage.PRIORITY_HIGH} {
+		stat.DepthByPriority[storage.PriorityName(priority)] = count.Queued[priority]
+		stat.Depth += count.Queued[priority]
+	}
+	return stat, nil
+}
+
+// RetryAfter returns delay which clients should wait before retrying rejected task.
+func (s *Service) RetryAfter() time.Duration {
+	return time.Duration(s.cfg.RetryAfter) * time.Second
+}
+
+// Position returns position of the file in the queue, zero if file isn't waiting in the queue.
+func (s *Service) Position(fileId int) (int, error) {
+	return s.storage.SelectJobPosition(fileId, time.Now().Unix(), s.aging())
+}
 
-	fileId, err := s.storage.SelectFile(t.Url, t.Hash)
+// DelayedTasks returns jobs of the failed tasks waiting for their next attempt by file id.
+func (s *Service) DelayedTasks() (map[int]storage.JobModel, error) {
+	jobs, err := s.storage.SelectDelayedJobs(time.Now().Unix())
 	if err != nil {
-		return fmt.Errorf("error while selecting file, url: %q, hash: %q", t.Url, t.Hash)
+		return nil, err
 	}
-	if fileId < 0 {
-		fileId, err = s.storage.InsertFile(&storage.FileModel{
-			Url:  t.Url,
-			Hash: t.Hash,
-		})
+	ret := make(map[int]storage.JobModel, len(jobs))
+	for _, job := range jobs {
+		ret[job.FileId] = job
+	}
+	return ret, nil
+}
+
+// Progress returns downloading progress of the in-flight task.
+func (s *Service) Progress(fileId int) (Progress, bool) {
+	return s.progress.Get(fileId)
+}
+
+// Subscribe returns channel of task events matched by filter
+// and function which must be called to release subscription.
+func (s *Service) Subscribe(filter EventFilter) (<-chan *Event, func()) {
+	ch := s.events.Subscribe(filter)
+	return ch, func() {
+		s.events.Unsubscribe(ch)
+	}
+}
+
+// processJobs claims and processes jobs until queue is empty or service is stopped.
+func (s *Service) processJobs(owner string) {
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		// Jobs of saturated hosts would be deferred at once, so they are left in the queue.
+		job, err := s.storage.ClaimJob(owner, time.Now().Unix(), s.leaseUntil(), s.aging(), s.limits.Saturated())
 		if err != nil {
-			return fmt.Errorf("error while inserting file, url: %q, hash: %q", t.Url, t.Hash)
+			s.logger.Errorf("Can't claim job: %v", err)
+			return
+		}
+		if job == nil {
+			return
+		}
+		if job.Claims > job.Attempts+1 {
+			s.logger.Infof("Continue downloading interrupted task %d (claims: %d)", job.FileId, job.Claims)
+		}
+		s.processJob(job, owner)
+	}
+}
+
+func (s *Service) processJob(job *storage.JobModel, owner string) {
+	t := &Task{
+		Id:       job.FileId,
+		Url:      job.Url,
+		Hash:     job.Hash,
+		HashAlgo: job.HashAlgo,
+	}
+	// Tasks with the same content are processed one by one, so content is downloaded once.
+	key := blobDigest(t)
+	if !s.cacheManager.TrySet(key) {
+		s.deferJob(job, owner, t, time.Duration(s.cfg.PollInterval)*time.Second, "the same content is downloading")
+		return
+	}
+	defer s.cacheManager.Remove(key)
+
+	// Cancelled job has to be processed to be aborted, so it isn't limited.
+	if !job.Cancelled {
+		ok, delay := s.limits.Acquire(t.Url)
+		if !ok {
+			s.deferJob(job, owner, t, delay, "limits of its host are exceeded")
+			return
+		}
+		defer s.limits.Release(t.Url)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancels.Add(t.Id, cancel)
+	stopLease := make(chan struct{})
+	go s.keepLease(job, owner, cancel, stopLease)
+
+	// Job could be cancelled after its worker died.
+	if job.Cancelled {
+		cancel()
+	}
+	err := s.processTask(ctx, t, job.Attempts+1)
+	if err != nil {
+		s.logger.Errorf("Error while processing task: %v", err)
+	}
+	close(stopLease)
+	s.cancels.Remove(t.Id)
+	cancel()
+
+	switch e := err.(type) {
+	case nil, *failedError:
+		if err := s.storage.DeleteJob(job.Id, owner); err != nil {
+			s.logger.Errorf("Can't delete job %d: %v", job.Id, err)
+		}
+	case *retryError:
+		s.delayJob(job, owner, t, e.delay)
+	default:
+		// Final status isn't logged (e.g. storage is unavailable), so the job is processed again later
+		// without counting the attempt.
+		s.deferJob(job, owner, t, time.Duration(s.cfg.PollInterval)*time.Second, "task is interrupted by error")
+	}
+}
+
+// keepLease extends lease of the in-flight job until stop channel is closed,
+// so job isn't claimed by another worker while it is processed. Job cancelled by another
+// service replica is aborted by cancel function.
+func (s *Service) keepLease(job *storage.JobModel, owner string, cancel context.CancelFunc, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(s.cfg.LeaseTimeout) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ok, err := s.storage.ExtendJob(job.Id, owner, s.leaseUntil())
+			if err != nil {
+				s.logger.Errorf("Can't extend lease of job %d: %v", job.Id, err)
+			} else if !ok {
+				s.abandonLease(job, cancel)
+				return
+			}
+		case <-stop:
+			return
 		}
 	}
+}
+
+// delayJob returns failed job to the queue till its next attempt, so worker is free to process other jobs.
+func (s *Service) delayJob(job *storage.JobModel, owner string, t *Task, delay time.Duration) {
+	availableAt := time.Now().Add(delay)
+	ok, err := s.storage.RetryJob(job.Id, owner, availableAt.Unix())
+	if err != nil {
+		// Job will be claimable again after its lease expiration.
+		s.logger.Errorf("Can't delay job %d: %v", job.Id, err)
+		return
+	}
+	if ok {
+		s.logger.Infof("Task %d will be retried at %s", t.Id, availableAt.Format(time.RFC3339))
+		return
+	}
+
+	// Job is cancelled while its attempt was failing (or lease is lost).
+	s.abortCancelledJob(job, owner, t)
+}
+
+// abortCancelledJob aborts job which can't be returned to the queue if it is cancelled
+// and is still leased by the owner.
+func (s *Service) abortCancelledJob(job *storage.JobModel, owner string, t *Task) {
+	current, err := s.storage.SelectJob(job.Id)
+	if err != nil {
+		s.logger.Errorf("Can't get job %d: %v", job.Id, err)
+		return
+	}
+	if current == nil || !current.Cancelled || current.Owner != owner {
+		s.logger.Errorf("Lease of job %d is lost", job.Id)
+		return
+	}
+	s.abortJob(job, owner, t)
+}
+
+// abortJob cancels task of the cancelled job and deletes the job.
+// Job is kept if cancellation isn't logged, so it is aborted again after its lease expiration.
+func (s *Service) abortJob(job *storage.JobModel, owner string, t *Task) {
+	if err := s.cancelTask(t); err != nil {
+		s.logger.Errorf("Can't abort job %d: %v", job.Id, err)
+		return
+	}
+	if err := s.storage.DeleteJob(job.Id, owner); err != nil {
+		s.logger.Errorf("Can't delete job %d: %v", job.Id, err)
+	}
+}
+
+// deferJob returns job to the queue without processing (e.g. because limits of its host are exceeded).
+// Worker is free to process other jobs meanwhile. Cancelled job can't be deferred, so it is aborted instead.
+func (s *Service) deferJob(job *storage.JobModel, owner string, t *Task, delay time.Duration, reason string) {
+	if job.Cancelled {
+		s.abortJob(job, owner, t)
+		return
+	}
+	// Job must not be claimable again within this second, otherwise workers would spin on it.
+	availableAt := time.Now().Unix() + int64(math.Ceil(delay.Seconds()))
+	if delay < time.Second {
+		availableAt = time.Now().Unix() + 1
+	}
+	ok, err := s.storage.DeferJob(job.Id, owner, availableAt)
+	if err != nil {
+		// Job will be claimable again after its lease expiration.
+		s.logger.Errorf("Can't defer job %d: %v", job.Id, err)
+		return
+	}
+	if !ok {
+		// Job is cancelled meanwhile (or lease is lost).
+		s.abortCancelledJob(job, owner, t)
+		return
+	}
+	s.logger.Debugf("Task %d is deferred for %v: %s", t.Id, delay, reason)
+}
 
-	if attempt > s.cfg.Attempts {
-		msg := fmt.Sprintf("all attempts are spent (count: %d)", s.cfg.Attempts)
-		s.logToStorage(fileId, storage.STATUS_FAILED, msg)
-		return fmt.Errorf(msg)
+// abandonLease aborts job if lease wasn't extended because job is cancelled.
+func (s *Service) abandonLease(job *storage.JobModel, cancel context.CancelFunc) {
+	current, err := s.storage.SelectJob(job.Id)
+	if err != nil {
+		s.logger.Errorf("Can't get job %d: %v", job.Id, err)
+		return
+	}
+	if current != nil && current.Cancelled {
+		s.logger.Infof("Job %d is cancelled", job.Id)
+		cancel()
+		return
 	}
+	s.logger.Errorf("Lease of job %d is lost", job.Id)
+}
+
+// aging returns waiting time (in seconds) which raises job by one priority level.
+func (s *Service) aging() int64 {
+	return int64(s.cfg.PriorityAging)
+}
 
-	completed, err := s.storage.CheckFileIsCompleted(1)
+func (s *Service) leaseUntil() int64 {
+	return time.Now().Add(time.Duration(s.cfg.LeaseTimeout) * time.Second).Unix()
+}
+
+func (s *Service) processTask(ctx context.Context, t *Task, attempt int) error {
+	if ctx.Err() != nil {
+		return s.cancelTask(t)
+	}
+
+	completed, err := s.storage.CheckFileIsCompleted(t.Id)
 	if err != nil {
 		return fmt.Errorf("error while checking file: %v", err)
 	}
@@ -120,141 +484,341 @@ func (s *Service) processTask(t *Task, attempt int, key string) error {
 	}
 
 	s.logger.Debugf("Processing service task. Attempt number: #%d", attempt)
-	s.logToStorage(fileId, storage.STATUS_PENDING, "Start processing task")
+	s.logToStorage(t, storage.STATUS_PENDING, "Start processing task")
+
+	blob, err := s.storage.AcquireBlob(t.Id, blobDigest(t))
+	if err != nil {
+		return fmt.Errorf("error while acquiring blob: %v", err)
+	}
+	if blob != nil {
+		return s.linkTask(t, blob)
+	}
+
+	filePath, err := s.download(ctx, t)
+	if err != nil && ctx.Err() != nil {
+		return s.cancelTask(t)
+	}
+	if err != nil {
+		return s.retryTask(t, attempt, err)
+	}
 
-	filePath, err := s.download(fileId, t)
+	mediaInfo, err := s.getMediaInfo(ctx, filePath)
+	if err != nil {
+		os.Remove(filePath)
+	}
+	if err != nil && ctx.Err() != nil {
+		return s.cancelTask(t)
+	}
 	if err != nil {
-		s.logToStorage(fileId, storage.STATUS_ERROR, fmt.Sprintf("Error while downloading file: %v", err))
-		return s.processTask(t, attempt+1, key)
+		return s.failTask(t, fmt.Sprintf("Error while getting media info: %v", err))
 	}
 
-	if err := s.validateChecksum(filePath, t.Hash); err != nil {
-		s.logToStorage(fileId, storage.STATUS_ERROR, fmt.Sprintf("Error while validating checksum: %v", err))
-		return s.processTask(t, attempt+1, key)
+	rawMediaInfo, err := json.Marshal(mediaInfo)
+	if err != nil {
+		return s.failTask(t, fmt.Sprintf("Error while marshalling media info: %v", err))
 	}
 
-	bitRate, resolution, err := s.getMediaInfo(filePath)
+	location, err := s.storeFile(ctx, t, filePath, string(rawMediaInfo))
+	if err != nil {
+		// Stored file is removed by the store, the rest is downloaded again.
+		os.Remove(filePath)
+	}
+	if err != nil && ctx.Err() != nil {
+		return s.cancelTask(t)
+	}
 	if err != nil {
-		s.logToStorage(fileId, storage.STATUS_FAILED, fmt.Sprintf("Error while getting media info: %v", err))
-		return fmt.Errorf("error while getting media info: %v", err)
+		return s.retryTask(t, attempt, &storeError{err})
 	}
+	s.logToStorage(t, storage.STATUS_PENDING, fmt.Sprintf("File is stored: %q", location))
 
-	_, err = s.storage.UpdateFile(&storage.FileModel{
-		Id:         fileId,
+	return s.completeTask(t, mediaInfo, string(rawMediaInfo), location)
+}
+
+// completeTask saves media info and location of the stored file.
+func (s *Service) completeTask(t *Task, mediaInfo *MediaInfo, rawMediaInfo, location string) error {
+	_, err := s.storage.UpdateFile(&storage.FileModel{
+		Id:         t.Id,
 		Url:        t.Url,
 		Hash:       t.Hash,
-		BitRate:    bitRate,
-		Resolution: resolution,
+		BitRate:    mediaInfo.VideoBitRate(),
+		Resolution: mediaInfo.Resolution(),
+		MediaInfo:  rawMediaInfo,
+		Location:   location,
 	})
 	if err != nil {
 		return fmt.Errorf("error while updating file: %v", err)
 	}
-	s.logToStorage(fileId, storage.STATUS_COMPLETED, "Task completed")
-
+	if err := s.storage.InsertMediaStreams(t.Id, mediaInfo.streamModels(t.Id)); err != nil {
+		return fmt.Errorf("error while inserting media streams: %v", err)
+	}
+	if err := s.logToStorage(t, storage.STATUS_COMPLETED, "Task completed"); err != nil {
+		return fmt.Errorf("error while completing task: %v", err)
+	}
 	return nil
 }
 
-func (s *Service) download(fileId int, t *Task) (string, error) {
-	tokens := strings.Split(t.Url, "/")
-	filePath := fmt.Sprintf("%s/%s-%s", s.cfg.OutputDir, tokens[len(tokens)-1], t.Hash)
+// failTask logs final status of the failed task. Returns failedError if status is logged,
+// otherwise task has to be processed again.
+func (s *Service) failTask(t *Task, msg string) error {
+	if err := s.logToStorage(t, storage.STATUS_FAILED, msg); err != nil {
+		return fmt.Errorf("error while failing task: %v", err)
+	}
+	return &failedError{message: msg}
+}
 
-	if _, err := os.Stat(filePath); err == nil {
-		if err = os.Remove(filePath); err != nil {
-			return "", fmt.Errorf("can't remove file %q from local filesystem", filePath)
-		}
+// retryTask returns retryError with backoff delay of the error kind, so failed task is retried by the queue.
+// Attempt is the total count of task attempts, so error kinds share one budget and the limit of the current
+// error kind caps the total: task is failed when attempt reaches attempts of the kind of its last error.
+func (s *Service) retryTask(t *Task, attempt int, err error) error {
+	kind := classifyError(err)
+	policy := s.retryPolicy(kind)
+
+	msg := fmt.Sprintf("Error while downloading file: %v", err)
+	switch err.(type) {
+	case *checksumError:
+		msg = fmt.Sprintf("Error while validating checksum: %v", err)
+	case *storeError:
+		msg = fmt.Sprintf("Error while storing file: %v", err)
 	}
+	s.logToStorage(t, storage.STATUS_ERROR, fmt.Sprintf("%s (%s error, attempt %d of %d)", msg, kind, attempt, policy.Attempts))
 
-	output, err := os.Create(filePath)
-	if err != nil {
-		return "", fmt.Errorf("error while creating file %q: %v", filePath, err)
+	if attempt >= policy.Attempts {
+		return s.failTask(t, fmt.Sprintf("all attempts are spent (count: %d)", attempt))
+	}
+
+	return &retryError{delay: retryDelay(policy, attempt, err), err: err}
+}
+
+// partPath returns path of the file which task is downloading to. It is unique for the task,
+// so concurrent tasks never write the same file.
+func (s *Service) partPath(t *Task) string {
+	return filepath.Join(s.cfg.OutputDir, fmt.Sprintf("%d.part", t.Id))
+}
+
+// removePartFile removes partially downloaded file of the task.
+func (s *Service) removePartFile(t *Task) {
+	partPath := s.partPath(t)
+	os.Remove(partPath)
+	removeResumeInfo(partPath)
+}
+
+// download writes remote file to the part file and renames it to `<output_dir>/<task id>-<name>`
+// when checksum is valid, so the downloaded file is never seen partially written.
+func (s *Service) download(ctx context.Context, t *Task) (string, error) {
+	partPath := s.partPath(t)
+
+	// Partial file can be resumed only if we know which version of the remote file it belongs to.
+	var offset int64
+	info := readResumeInfo(partPath)
+	if stat, err := os.Stat(partPath); err == nil && info != nil {
+		offset = stat.Size()
 	}
-	defer output.Close()
 
-	s.logToStorage(fileId, storage.STATUS_PENDING, fmt.Sprintf("Start downloading from url: %q", t.Url))
+	request, err := http.NewRequest(http.MethodGet, t.Url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error while creating request to url %q: %v", t.Url, err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", s.cfg.Http.UserAgent)
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", info.validator())
+		s.logToStorage(t, storage.STATUS_PENDING, fmt.Sprintf("Resume downloading from url: %q (offset: %d bytes)", t.Url, offset))
+	} else {
+		s.logToStorage(t, storage.STATUS_PENDING, fmt.Sprintf("Start downloading from url: %q", t.Url))
+	}
 	start := time.Now()
 
-	response, err := http.Get(t.Url)
+	response, err := s.client.Do(request)
 	if err != nil {
-		return "", fmt.Errorf("error while downloading url %q: %v", t.Url, err)
+		return "", &taskError{fmt.Sprintf("error while downloading url %q", t.Url), err}
 	}
 	defer response.Body.Close()
 
-	n, err := io.Copy(output, response.Body)
-	if err != nil {
-		return "", fmt.Errorf("error while copying to file %q: %v", filePath, err)
+	flags := os.O_CREATE | os.O_RDWR
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		if offset == 0 {
+			return "", fmt.Errorf("unexpected partial response from url %q", t.Url)
+		}
+		if err := info.checkPartialResponse(response, offset); err != nil {
+			removeResumeInfo(partPath)
+			return "", fmt.Errorf("can't resume downloading url %q: %v", t.Url, err)
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// Origin doesn't support ranges or remote file was changed: download it from scratch.
+		offset = 0
+		flags |= os.O_TRUNC
+		if info = newResumeInfo(response); info != nil {
+			if err := writeResumeInfo(partPath, info); err != nil {
+				s.logger.Errorf("Can't save resume info for file %q: %v", partPath, err)
+			}
+		} else {
+			removeResumeInfo(partPath)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		removeResumeInfo(partPath)
+		return "", fmt.Errorf("partial file %q doesn't match url %q: range not satisfiable", partPath, t.Url)
+	default:
+		return "", newHttpStatusError(t.Url, response)
 	}
 
-	s.logToStorage(fileId, storage.STATUS_PENDING, fmt.Sprintf(
-		"Finish downloading. Time elapsed: %q (%d bytes downloaded), file path: %q",
-		time.Since(start),
-		n,
-		filePath,
-	))
+	total := int64(-1)
+	if response.ContentLength >= 0 {
+		total = offset + response.ContentLength
+	}
+	if err := checkResponse(&s.cfg.Http, response, total); err != nil {
+		return "", &taskError{fmt.Sprintf("response from url %q is rejected", t.Url), err}
+	}
 
-	return filePath, nil
-}
+	algo, err := checksum.Get(t.HashAlgo)
+	if err != nil {
+		return "", err
+	}
+	hasher := algo.New()
 
-func (s *Service) validateChecksum(filePath, checksum string) error {
-	s.logger.Debugf("Get hash from file: %q", filePath)
-	hash, err := s.getMD5(filePath)
+	output, err := os.OpenFile(partPath, flags, 0644)
 	if err != nil {
-		return fmt.Errorf("error while getting md5 hash: %v", err)
+		return "", &taskError{fmt.Sprintf("error while creating file %q", partPath), err}
 	}
-	if hash != checksum {
-		return fmt.Errorf("suspusious file. Checksum from url: %q mismatch with file hash: %q", checksum, hash)
+	defer output.Close()
+
+	// Resumed part of the file have to be hashed before the rest of the stream.
+	if offset > 0 {
+		if _, err := io.CopyN(hasher, output, offset); err != nil {
+			return "", &taskError{fmt.Sprintf("error while hashing partial file %q", partPath), err}
+		}
 	}
-	return nil
-}
 
-func (s *Service) getMD5(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+	body := newIdleReader(response.Body, time.Duration(s.cfg.Http.IdleTimeout)*time.Second)
+	defer body.Stop()
+	throttled := newThrottledReader(ctx, body, s.limits.Bandwidth(t.Url), s.bandwidth)
+	limited := newLimitedReader(throttled, offset, s.cfg.Http.MaxBodySize)
+	reader := newProgressReader(limited, offset, total)
+	s.progress.Track(t.Id, reader)
+	defer s.progress.Untrack(t.Id)
+
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	go s.publishProgress(t, reader, stopProgress)
+
+	n, err := io.Copy(io.MultiWriter(output, hasher), reader)
 	if err != nil {
-		return "", err
+		if _, ok := err.(*rejectedError); ok {
+			// Rejected file is never resumed.
+			os.Remove(partPath)
+			removeResumeInfo(partPath)
+		}
+		return "", &taskError{fmt.Sprintf("error while copying to file %q", partPath), err}
+	}
+	removeResumeInfo(partPath)
+
+	if total >= 0 && offset+n != total {
+		os.Remove(partPath)
+		return "", &taskError{
+			fmt.Sprintf("size of file %q mismatch: %d bytes expected, %d bytes downloaded", partPath, total, offset+n),
+			io.ErrUnexpectedEOF,
+		}
 	}
-	defer file.Close()
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != t.Hash {
+		os.Remove(partPath)
+		return "", &checksumError{expected: t.Hash, actual: hash}
+	}
+
+	filePath, err := s.outputPath(fmt.Sprintf("%d-%s", t.Id, outputFileName(t.Url, response)))
+	if err != nil {
+		os.Remove(partPath)
 		return "", err
 	}
-	hashInBytes := hash.Sum(nil)[:16]
+	if err := output.Sync(); err != nil {
+		return "", &taskError{fmt.Sprintf("error while syncing file %q", partPath), err}
+	}
+	output.Close()
+	if err := os.Rename(partPath, filePath); err != nil {
+		return "", &taskError{fmt.Sprintf("error while renaming file %q", partPath), err}
+	}
 
-	return hex.EncodeToString(hashInBytes), nil
+	s.logToStorage(t, storage.STATUS_PENDING, fmt.Sprintf(
+		"Finish downloading. Time elapsed: %q (%d bytes downloaded, %d bytes resumed), file path: %q",
+		time.Since(start),
+		n,
+		offset,
+		filePath,
+	))
+
+	return filePath, nil
 }
 
-func (s *Service) getMediaInfo(filePath string) (bitRate, resolution string, err error) {
+func (s *Service) getMediaInfo(ctx context.Context, filePath string) (*MediaInfo, error) {
 	cmdName := "ffprobe"
 	cmdArgs := []string{
-		"-v", "error", "-show_entries", "stream=width,height,bit_rate", "-of", "default=noprint_wrappers=1", filePath,
+		"-v", "error", "-of", "json", "-show_format", "-show_streams", filePath,
 	}
 
 	s.logger.Debugf("Get media info from file: %q by shell command: %q", filePath, cmdName)
-	cmdOut, err := exec.Command(cmdName, cmdArgs...).Output()
+	cmdOut, err := exec.CommandContext(ctx, cmdName, cmdArgs...).Output()
 	if err != nil {
-		return "", "", fmt.Errorf("there was an error running %q command: %v", cmdName, err)
+		return nil, fmt.Errorf("there was an error running %q command: %v", cmdName, err)
 	}
 
-	match := s.regexp.FindStringSubmatch(string(cmdOut))
+	return parseMediaInfo(cmdOut)
+}
 
-	return fmt.Sprintf("%sx%s", match[1], match[2]), string(match[3]), nil
+// publishProgress sends progress events of the in-flight task until stop channel is closed.
+func (s *Service) publishProgress(t *Task, reader *progressReader, stop <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			progress := reader.Progress()
+			s.events.Publish(&Event{
+				Type:     EVENT_PROGRESS,
+				TaskId:   t.Id,
+				Url:      t.Url,
+				Hash:     t.Hash,
+				Progress: &progress,
+			})
+		case <-stop:
+			return
+		}
+	}
 }
 
-func (s *Service) logToStorage(fileId, status int, msg string) error {
+func (s *Service) logToStorage(t *Task, status int, msg string) error {
 	switch status {
-	case storage.STATUS_PENDING, storage.STATUS_COMPLETED:
+	case storage.STATUS_PENDING, storage.STATUS_COMPLETED, storage.STATUS_CANCELLED:
 		s.logger.Info(msg)
 	case storage.STATUS_FAILED, storage.STATUS_ERROR:
 		s.logger.Error(msg)
 	}
 
+	s.events.Publish(&Event{
+		Type:    EVENT_STATUS,
+		TaskId:  t.Id,
+		Url:     t.Url,
+		Hash:    t.Hash,
+		Status:  storage.StatusName(status),
+		Message: msg,
+	})
+
+	// Final status is notified even if it isn't logged, so callback isn't lost.
 	_, err := s.storage.InsertLog(&storage.LogModel{
-		FileId:  fileId,
+		FileId:  t.Id,
 		Message: msg,
 		Status:  status,
 	})
 	if err != nil {
-		return err
+		s.logger.Errorf("Can't log status of task %d: %v", t.Id, err)
 	}
 
-	return nil
+	if status == storage.STATUS_COMPLETED || status == storage.STATUS_FAILED || status == storage.STATUS_CANCELLED {
+		if err := s.notifier.Notify(t.Id, status, msg); err != nil {
+			s.logger.Errorf("Can't notify about task %d: %v", t.Id, err)
+		}
+	}
+
+	return err
 }
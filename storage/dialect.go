@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// dialect describes differences of sql databases supported by storage.
+// All queries are written with `?` placeholders and rebound for the database.
+type dialect struct {
+	name       string
+	migrations []migration
+	// numberedPlaceholders means that database uses $1, $2, .. placeholders.
+	numberedPlaceholders bool
+	// returningId means that database doesn't support LastInsertId
+	// and inserted id is returned by `RETURNING id` clause.
+	returningId bool
+	// advisoryLocks means that database supports pg_advisory_lock.
+	advisoryLocks bool
+}
+
+func (d *dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	tokens := strings.Split(query, "?")
+	ret := tokens[0]
+	for i, token := range tokens[1:] {
+		ret += "$" + strconv.Itoa(i+1) + token
+	}
+	return ret
+}
+
+// writeLockId is the key of the advisory lock which serializes transactions started by beginWrite.
+const writeLockId = 7355609
+
+// beginWrite starts transaction which reads rows and then writes depending on them (e.g. inserts
+// file if it doesn't exist), so concurrent transactions must not interleave. SQLite transactions
+// are immediate (see sqliteDsn), other databases take the advisory lock till the end of transaction.
+func (d *dialect) beginWrite(db *sql.DB) (*sql.Tx, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if d.advisoryLocks {
+		if _, err := tx.Exec(d.rebind("SELECT pg_advisory_xact_lock(?)"), writeLockId); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+func (d *dialect) prepare(db *sql.DB, query string) (*sql.Stmt, error) {
+	return db.Prepare(d.rebind(query))
+}
+
+// prepareInsert prepares INSERT statement which can be executed by insert method.
+func (d *dialect) prepareInsert(db *sql.DB, query string) (*sql.Stmt, error) {
+	if d.returningId {
+		query += " RETURNING id"
+	}
+	return d.prepare(db, query)
+}
+
+// insert executes statement prepared by prepareInsert and returns id of the inserted row.
+func (d *dialect) insert(stmt *sql.Stmt, args ...interface{}) (int, error) {
+	if d.returningId {
+		var id int
+		if err := stmt.QueryRow(args...).Scan(&id); err != nil {
+			return -1, err
+		}
+		return id, nil
+	}
+
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	return int(id), nil
+}
+
+// open opens database, applies pending migrations and prepares statements.
+// Panics if any operations fail.
+func (d *dialect) open(logger *logrus.Logger, driver, dsn string) Storager {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		panic(fmt.Sprintf("Can't open db: %v", err))
+	}
+	if err := migrate(logger, db, d); err != nil {
+		panic(fmt.Sprintf("Can't migrate db: %v", err))
+	}
+	s, err := prepareStatements(logger, db, d)
+	if err != nil {
+		panic(fmt.Sprintf("Can't prepare db statetement: %v", err))
+	}
+	return s
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		query    string
+		postgres string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM files WHERE id=?", "SELECT * FROM files WHERE id=$1"},
+		{"INSERT INTO log(file_id, status, message) VALUES (?,?,?)", "INSERT INTO log(file_id, status, message) VALUES ($1,$2,$3)"},
+		{"? ? ? ? ? ? ? ? ? ? ?", "$1 $2 $3 $4 $5 $6 $7 $8 $9 $10 $11"},
+		{"?", "$1"},
+	}
+	for _, test := range tests {
+		if query := postgresDialect.rebind(test.query); query != test.postgres {
+			t.Errorf("postgres rebind(%q) = %q; want %q", test.query, query, test.postgres)
+		}
+		if query := sqliteDialect.rebind(test.query); query != test.query {
+			t.Errorf("sqlite rebind(%q) = %q; want unchanged query", test.query, query)
+		}
+	}
+}
+
+// fakePostgresDriver records queries instead of executing them. Like lib/pq it doesn't support
+// LastInsertId, so inserted ids must be returned by `RETURNING id` (all such queries return fakeInsertedId).
+// Schema version is always 0, other queries return no rows.
+type fakePostgresDriver struct {
+	mu      sync.Mutex
+	queries []fakeQuery
+}
+
+// fakeQuery is the prepared query, args are nil until it is executed.
+type fakeQuery struct {
+	query    string
+	args     []driver.Value
+	executed bool
+}
+
+const fakeInsertedId = 42
+
+var fakePostgres = &fakePostgresDriver{}
+
+func init() {
+	sql.Register("fakepostgres", fakePostgres)
+}
+
+func (d *fakePostgresDriver) record(q fakeQuery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, q)
+}
+
+// reset returns recorded queries and clears them.
+func (d *fakePostgresDriver) reset() []fakeQuery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ret := d.queries
+	d.queries = nil
+	return ret
+}
+
+func (d *fakePostgresDriver) Open(name string) (driver.Conn, error) {
+	return &fakePostgresConn{d: d}, nil
+}
+
+type fakePostgresConn struct {
+	d *fakePostgresDriver
+}
+
+func (c *fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.record(fakeQuery{query: query})
+	return &fakePostgresStmt{d: c.d, query: query}, nil
+}
+
+func (c *fakePostgresConn) Close() error {
+	return nil
+}
+
+func (c *fakePostgresConn) Begin() (driver.Tx, error) {
+	c.d.record(fakeQuery{query: "BEGIN", executed: true})
+	return c, nil
+}
+
+func (c *fakePostgresConn) Commit() error {
+	return nil
+}
+
+func (c *fakePostgresConn) Rollback() error {
+	return nil
+}
+
+type fakePostgresStmt struct {
+	d     *fakePostgresDriver
+	query string
+}
+
+func (s *fakePostgresStmt) Close() error {
+	return nil
+}
+
+func (s *fakePostgresStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.record(fakeQuery{query: s.query, args: args, executed: true})
+	return fakePostgresResult{}, nil
+}
+
+func (s *fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.record(fakeQuery{query: s.query, args: args, executed: true})
+	switch {
+	case strings.Contains(s.query, "MAX(version)"):
+		return &fakePostgresRows{values: []driver.Value{int64(0)}}, nil
+	case strings.HasSuffix(strings.TrimSpace(s.query), "RETURNING id"):
+		return &fakePostgresRows{values: []driver.Value{int64(fakeInsertedId)}}, nil
+	}
+	return &fakePostgresRows{}, nil
+}
+
+type fakePostgresResult struct{}
+
+func (fakePostgresResult) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported by this driver")
+}
+
+func (fakePostgresResult) RowsAffected() (int64, error) {
+	return 0, nil
+}
+
+// fakePostgresRows contains at most one row of values.
+type fakePostgresRows struct {
+	values []driver.Value
+}
+
+func (r *fakePostgresRows) Columns() []string {
+	return make([]string, len(r.values))
+}
+
+func (r *fakePostgresRows) Close() error {
+	return nil
+}
+
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
+
+var placeholderRe = regexp.MustCompile(`\$(\d+)`)
+
+// checkPostgresQuery checks that query has only numbered placeholders $1..$n without gaps
+// and n is the count of args if query is executed.
+func checkPostgresQuery(t *testing.T, q fakeQuery) {
+	if strings.Contains(q.query, "?") {
+		t.Errorf("query has not rebound placeholder: %s", q.query)
+	}
+	numbers := make(map[int]bool)
+	for _, m := range placeholderRe.FindAllStringSubmatch(q.query, -1) {
+		n, _ := strconv.Atoi(m[1])
+		numbers[n] = true
+	}
+	for n := 1; n <= len(numbers); n++ {
+		if !numbers[n] {
+			t.Errorf("query placeholders %v aren't sequential: %s", numbers, q.query)
+			break
+		}
+	}
+	if q.executed && q.query != "BEGIN" && len(numbers) != len(q.args) {
+		t.Errorf("query has %d placeholders, but executed with %d args %v: %s", len(numbers), len(q.args), q.args, q.query)
+	}
+}
+
+func TestPostgresQueries(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	fakePostgres.reset()
+	s := postgresDialect.open(logger, "fakepostgres", "")
+
+	// Migrations are applied under the advisory lock, each one followed by its version.
+	queries := fakePostgres.reset()
+	executed := make([]fakeQuery, 0)
+	for _, q := range queries {
+		checkPostgresQuery(t, q)
+		if q.executed {
+			executed = append(executed, q)
+		}
+	}
+	if len(executed) == 0 || executed[0].query != "SELECT pg_advisory_lock($1)" || executed[0].args[0] != int64(migrationsLockId) {
+		t.Fatalf("first query isn't migrations lock: %+v", executed)
+	}
+	next := 1
+	for _, m := range postgresMigrations {
+		for next < len(executed) &&
+			!(strings.HasPrefix(executed[next].query, "INSERT INTO schema_migrations") && executed[next].args[0] == int64(m.version)) {
+			next++
+		}
+		if next+1 >= len(executed) {
+			t.Fatalf("migration #%d (%s) isn't applied", m.version, m.name)
+		}
+		if m.up != "" && executed[next-1].query != m.up && m.upData == nil {
+			t.Fatalf("migration #%d (%s) version is stored after %+v; want migration itself", m.version, m.name, executed[next-1])
+		}
+		for _, sqlite := range []string{"AUTOINCREMENT", "INTEGER PRIMARY KEY", "DATETIME"} {
+			if strings.Contains(strings.ToUpper(m.up), sqlite) {
+				t.Errorf("migration #%d (%s) has SQLite DDL %s", m.version, m.name, sqlite)
+			}
+		}
+	}
+	if unlock := executed[next+1]; unlock.query != "SELECT pg_advisory_unlock($1)" || unlock.args[0] != int64(migrationsLockId) {
+		t.Fatalf("migrations lock isn't released after migrations: %+v", unlock)
+	}
+
+	// Inserted ids are returned by the insert statements.
+	ddl := make(map[string]bool)
+	for _, m := range postgresMigrations {
+		ddl[m.up] = true
+	}
+	for _, q := range queries {
+		if ddl[q.query] {
+			continue
+		}
+		for _, table := range []string{"files", "callbacks", "jobs", "batches"} {
+			if strings.Contains(q.query, "INSERT INTO "+table+"(") && !strings.HasSuffix(strings.TrimSpace(q.query), "RETURNING id") {
+				t.Errorf("insert into %s doesn't return id: %s", table, q.query)
+			}
+		}
+	}
+	if id, err := s.InsertFile(&FileModel{Url: "http://host/a.mp4", Hash: "hash", HashAlgo: "md5"}); err != nil || id != fakeInsertedId {
+		t.Fatalf("InsertFile() = %d, %v; want %d", id, err, fakeInsertedId)
+	}
+	if id, err := s.InsertCallback(&CallbackModel{FileId: 1, Url: "http://client/"}); err != nil || id != fakeInsertedId {
+		t.Fatalf("InsertCallback() = %d, %v; want %d", id, err, fakeInsertedId)
+	}
+
+	// Write transactions take the advisory lock first.
+	fakePostgres.reset()
+	if id, err := s.EnqueueFile(&FileModel{Url: "http://host/a.mp4", Hash: "hash", HashAlgo: "md5"}, PRIORITY_NORMAL, 100); err != nil || id != fakeInsertedId {
+		t.Fatalf("EnqueueFile() = %d, %v; want %d", id, err, fakeInsertedId)
+	}
+	executed = executed[:0]
+	for _, q := range fakePostgres.reset() {
+		checkPostgresQuery(t, q)
+		if q.executed {
+			executed = append(executed, q)
+		}
+	}
+	if len(executed) < 2 || executed[0].query != "BEGIN" ||
+		executed[1].query != "SELECT pg_advisory_xact_lock($1)" || executed[1].args[0] != int64(writeLockId) {
+		t.Fatalf("EnqueueFile() queries %+v; want write lock first", executed)
+	}
+
+	// Query skipping hosts is built on the fly.
+	if job, err := s.ClaimJob("owner", 100, 200, 10, []string{"a", "b", "c"}); err != nil || job != nil {
+		t.Fatalf("ClaimJob() = %+v, %v; want nil", job, err)
+	}
+	queries = fakePostgres.reset()
+	if len(queries) == 0 || !strings.Contains(queries[len(queries)-1].query, "host NOT IN ($3,$4,$5)") {
+		t.Fatalf("ClaimJob() queries %+v; want hosts to be skipped", queries)
+	}
+	for _, q := range queries {
+		checkPostgresQuery(t, q)
+	}
+}
@@ -0,0 +1,755 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// memoryStorage is the thread-safe in-memory implementation of Storager.
+// It behaves like the sql storage, but all data is lost when process exits.
+type memoryStorage struct {
+	logger *logrus.Logger
+	mu     sync.RWMutex
+
+	files        map[int]*FileModel
+	logs         map[int][]LogModel
+	callbacks    map[int]*CallbackModel
+	mediaStreams map[int][]MediaStreamModel
+	jobs         map[int]*JobModel
+	batches      map[int]*BatchModel
+	blobs        map[string]*BlobModel
+
+	lastFileId     int
+	lastCallbackId int
+	lastJobId      int
+	lastBatchId    int
+}
+
+// NewMemoryStorage creates empty in-memory storage (for tests and throwaway environments).
+func NewMemoryStorage(logger *logrus.Logger) Storager {
+	return &memoryStorage{
+		logger:       logger,
+		files:        make(map[int]*FileModel),
+		logs:         make(map[int][]LogModel),
+		callbacks:    make(map[int]*CallbackModel),
+		mediaStreams: make(map[int][]MediaStreamModel),
+		jobs:         make(map[int]*JobModel),
+		batches:      make(map[int]*BatchModel),
+		blobs:        make(map[string]*BlobModel),
+	}
+}
+
+func (s *memoryStorage) CheckFileIsCompleted(fileId int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.files[fileId]; !ok {
+		return false, nil
+	}
+	for _, l := range s.logs[fileId] {
+		if l.Status == STATUS_COMPLETED {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStorage) SelectFile(url, hash string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if file := s.findFile(url, hash); file != nil {
+		return file.Id, nil
+	}
+	return -1, nil
+}
+
+func (s *memoryStorage) SelectFileById(fileId int) (*FileModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, ok := s.files[fileId]
+	if !ok {
+		return nil, nil
+	}
+	ret := *file
+	return &ret, nil
+}
+
+func (s *memoryStorage) SelectLogs(fileId int) ([]LogModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append(make([]LogModel, 0), s.logs[fileId]...), nil
+}
+
+func (s *memoryStorage) GetStatisticByUrl(url, hash string) (Statistic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := make([]*FileModel, 0, 1)
+	if file := s.findFile(url, hash); file != nil {
+		files = append(files, file)
+	}
+	return s.statistic(files), nil
+}
+
+func (s *memoryStorage) GetStatistic() (Statistic, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := make([]*FileModel, 0, len(s.files))
+	for _, id := range s.fileIds() {
+		files = append(files, s.files[id])
+	}
+	return s.statistic(files), nil
+}
+
+func (s *memoryStorage) InsertFile(model *FileModel) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertFile(model)
+}
+
+func (s *memoryStorage) insertFile(model *FileModel) (int, error) {
+	if s.findFile(model.Url, model.Hash) != nil {
+		return -1, fmt.Errorf("file with url %q and hash %q already exists", model.Url, model.Hash)
+	}
+	s.lastFileId++
+	s.files[s.lastFileId] = &FileModel{
+		Id:          s.lastFileId,
+		Url:         model.Url,
+		Hash:        model.Hash,
+		HashAlgo:    model.HashAlgo,
+		Resolution:  model.Resolution,
+		BitRate:     model.BitRate,
+		CallbackUrl: model.CallbackUrl,
+	}
+	return s.lastFileId, nil
+}
+
+func (s *memoryStorage) UpdateFile(model *FileModel) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if file, ok := s.files[model.Id]; ok {
+		file.BitRate = model.BitRate
+		file.Resolution = model.Resolution
+		file.MediaInfo = model.MediaInfo
+		file.Location = model.Location
+	}
+	return model.Id, nil
+}
+
+func (s *memoryStorage) UpdateFileCallback(fileId int, callbackUrl string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if file, ok := s.files[fileId]; ok {
+		file.CallbackUrl = callbackUrl
+	}
+	return nil
+}
+
+func (s *memoryStorage) InsertCallback(model *CallbackModel) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastCallbackId++
+	c := *model
+	c.Id = s.lastCallbackId
+	s.callbacks[c.Id] = &c
+	return c.Id, nil
+}
+
+func (s *memoryStorage) UpdateCallback(model *CallbackModel) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.callbacks[model.Id]; ok {
+		c.Status = model.Status
+		c.Attempts = model.Attempts
+		c.NextAttemptAt = model.NextAttemptAt
+		c.LastError = model.LastError
+		c.Owner = ""
+		c.LeaseUntil = 0
+	}
+	return model.Id, nil
+}
+
+func (s *memoryStorage) SelectPendingCallbacks(until int64) ([]CallbackModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]CallbackModel, 0)
+	for _, c := range s.callbacks {
+		if c.Status == CALLBACK_PENDING && c.NextAttemptAt <= until {
+			ret = append(ret, *c)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].NextAttemptAt != ret[j].NextAttemptAt {
+			return ret[i].NextAttemptAt < ret[j].NextAttemptAt
+		}
+		return ret[i].Id < ret[j].Id
+	})
+	return ret, nil
+}
+
+// ClaimCallback leases the first pending callback, which is due and isn't leased, to the owner until leaseUntil.
+// Returns nil if there are no callbacks to deliver.
+func (s *memoryStorage) ClaimCallback(owner string, now, leaseUntil int64) (*CallbackModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claimed *CallbackModel
+	for _, c := range s.callbacks {
+		if c.Status != CALLBACK_PENDING || c.NextAttemptAt > now || c.LeaseUntil > now {
+			continue
+		}
+		if claimed == nil || c.NextAttemptAt < claimed.NextAttemptAt ||
+			c.NextAttemptAt == claimed.NextAttemptAt && c.Id < claimed.Id {
+			claimed = c
+		}
+	}
+	if claimed == nil {
+		return nil, nil
+	}
+	claimed.Owner = owner
+	claimed.LeaseUntil = leaseUntil
+	c := *claimed
+	return &c, nil
+}
+
+// InsertMediaStreams replaces all streams of the file.
+// Nothing is changed if streams contain duplicated index.
+func (s *memoryStorage) InsertMediaStreams(fileId int, streams []MediaStreamModel) error {
+	indexes := make(map[int]bool, len(streams))
+	ret := make([]MediaStreamModel, 0, len(streams))
+	for _, m := range streams {
+		if indexes[m.Index] {
+			return fmt.Errorf("duplicated stream index %d of file %d", m.Index, fileId)
+		}
+		indexes[m.Index] = true
+		m.FileId = fileId
+		ret = append(ret, m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Index < ret[j].Index })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mediaStreams[fileId] = ret
+	return nil
+}
+
+func (s *memoryStorage) SelectMediaStreams(fileId int) ([]MediaStreamModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append(make([]MediaStreamModel, 0), s.mediaStreams[fileId]...), nil
+}
+
+func (s *memoryStorage) SelectFilesByMediaStream(filter *MediaStreamFilter) ([]FileModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]FileModel, 0)
+	for _, id := range s.fileIds() {
+		for _, m := range s.mediaStreams[id] {
+			if !filter.match(&m) {
+				continue
+			}
+			file := s.files[id]
+			ret = append(ret, FileModel{
+				Id:         file.Id,
+				Url:        file.Url,
+				Hash:       file.Hash,
+				HashAlgo:   file.HashAlgo,
+				BitRate:    file.BitRate,
+				Resolution: file.Resolution,
+				Location:   file.Location,
+			})
+			break
+		}
+	}
+	return ret, nil
+}
+
+// EnqueueFile inserts file (or updates callback url of the existing one) and queues job for it.
+// File has at most one queued job, its priority is raised if needed.
+func (s *memoryStorage) EnqueueFile(model *FileModel, priority int, now int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enqueueFile(model, priority, now)
+}
+
+func (s *memoryStorage) enqueueFile(model *FileModel, priority int, now int64) (int, error) {
+	file := s.findFile(model.Url, model.Hash)
+	if file == nil {
+		if _, err := s.insertFile(model); err != nil {
+			return -1, err
+		}
+		file = s.files[s.lastFileId]
+	} else if model.CallbackUrl != "" {
+		file.CallbackUrl = model.CallbackUrl
+	}
+
+	for _, job := range s.jobs {
+		if job.FileId == file.Id {
+			if job.Priority < priority {
+				job.Priority = priority
+			}
+			return file.Id, nil
+		}
+	}
+	s.lastJobId++
+	s.jobs[s.lastJobId] = &JobModel{
+		Id:        s.lastJobId,
+		FileId:    file.Id,
+		Host:      UrlHost(file.Url),
+		Priority:  priority,
+		CreatedAt: now,
+	}
+	return file.Id, nil
+}
+
+// ClaimJob leases the first claimable (not leased and available) job to the owner until leaseUntil.
+// Jobs are ordered by priority with aging: waiting for aging seconds is equal to one priority level.
+// Zero aging means strict priority. Jobs of skipHosts are left in the queue.
+// Returns nil if there are no claimable jobs.
+func (s *memoryStorage) ClaimJob(owner string, now, leaseUntil, aging int64, skipHosts []string) (*JobModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	skip := make(map[string]bool, len(skipHosts))
+	for _, host := range skipHosts {
+		skip[host] = true
+	}
+	for _, job := range s.claimableJobs(now, aging) {
+		if skip[job.Host] && !job.Cancelled {
+			continue
+		}
+		job.Owner = owner
+		job.LeaseUntil = leaseUntil
+		job.Claims++
+		return s.jobWithFile(job), nil
+	}
+	return nil, nil
+}
+
+// SelectJob returns job by id or nil if job doesn't exist.
+func (s *memoryStorage) SelectJob(jobId int) (*JobModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[jobId]
+	if !ok {
+		return nil, nil
+	}
+	return s.jobWithFile(job), nil
+}
+
+// ExtendJob prolongs lease of the job.
+// Returns false if job is cancelled or is not owned by the owner anymore.
+func (s *memoryStorage) ExtendJob(jobId int, owner string, leaseUntil int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[jobId]
+	if !ok || job.Owner != owner || job.Cancelled {
+		return false, nil
+	}
+	job.LeaseUntil = leaseUntil
+	return true, nil
+}
+
+// DeleteJob removes finished job. Job which is owned by another worker is left as is.
+func (s *memoryStorage) DeleteJob(jobId int, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.jobs[jobId]; ok && job.Owner == owner {
+		delete(s.jobs, jobId)
+	}
+	return nil
+}
+
+// DeleteQueuedJob removes job of the file if it isn't leased by any worker.
+// Returns false if there is no such job.
+func (s *memoryStorage) DeleteQueuedJob(fileId int, now int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, job := range s.jobs {
+		if job.FileId == fileId && job.LeaseUntil <= now {
+			delete(s.jobs, id)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CancelJob marks job of the file leased by worker as cancelled, so its lease is not extended anymore.
+// Returns false if there is no such job.
+func (s *memoryStorage) CancelJob(fileId int, now int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.FileId == fileId && job.LeaseUntil > now {
+			job.Cancelled = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SelectJobPosition returns position of the file job in the queue,
+// zero if file isn't waiting in the queue or its job is delayed till the next attempt.
+func (s *memoryStorage) SelectJobPosition(fileId int, now, aging int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i, job := range s.claimableJobs(now, aging) {
+		if job.FileId == fileId {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// CountJobs returns count of waiting jobs by priority and count of leased jobs.
+func (s *memoryStorage) CountJobs(now int64) (*JobsCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := &JobsCount{Queued: make(map[int]int)}
+	for _, job := range s.jobs {
+		if job.LeaseUntil > now {
+			ret.Leased++
+			continue
+		}
+		ret.Queued[job.Priority]++
+		if job.AvailableAt > now {
+			ret.Delayed++
+		}
+	}
+	return ret, nil
+}
+
+// RetryJob returns job leased by the owner to the queue, job is claimable again after availableAt.
+// Returns false if job is cancelled or is not owned by the owner anymore.
+func (s *memoryStorage) RetryJob(jobId int, owner string, availableAt int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[jobId]
+	if !ok || job.Owner != owner || job.Cancelled {
+		return false, nil
+	}
+	job.Owner = ""
+	job.LeaseUntil = 0
+	job.AvailableAt = availableAt
+	job.Attempts++
+	return true, nil
+}
+
+// DeferJob returns job leased by the owner to the queue without processing (neither claim nor attempt is counted),
+// job is claimable again after availableAt. Returns false if job is cancelled or is not owned by the owner anymore.
+func (s *memoryStorage) DeferJob(jobId int, owner string, availableAt int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[jobId]
+	if !ok || job.Owner != owner || job.Cancelled {
+		return false, nil
+	}
+	job.Owner = ""
+	job.LeaseUntil = 0
+	job.AvailableAt = availableAt
+	job.Claims--
+	return true, nil
+}
+
+// SelectDelayedJobs returns jobs waiting for their next attempt ordered by its time.
+func (s *memoryStorage) SelectDelayedJobs(now int64) ([]JobModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]JobModel, 0)
+	for _, job := range s.jobs {
+		if job.LeaseUntil <= now && job.AvailableAt > now {
+			ret = append(ret, *s.jobWithFile(job))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].AvailableAt != ret[j].AvailableAt {
+			return ret[i].AvailableAt < ret[j].AvailableAt
+		}
+		return ret[i].Id < ret[j].Id
+	})
+	return ret, nil
+}
+
+// EnqueueBatch enqueues all files (as EnqueueFile does) and groups them into the batch.
+// Returns id of the batch and ids of the files.
+func (s *memoryStorage) EnqueueBatch(models []*FileModel, priority int, now int64) (int, []int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := &BatchModel{CreatedAt: now}
+	fileIds := make([]int, 0, len(models))
+	for _, model := range models {
+		fileId, err := s.enqueueFile(model, priority, now)
+		if err != nil {
+			return -1, nil, err
+		}
+		batch.Files = append(batch.Files, BatchFileModel{FileId: fileId})
+		fileIds = append(fileIds, fileId)
+	}
+
+	s.lastBatchId++
+	batch.Id = s.lastBatchId
+	s.batches[batch.Id] = batch
+	return batch.Id, fileIds, nil
+}
+
+// SelectBatch returns batch with its files or nil if batch doesn't exist.
+func (s *memoryStorage) SelectBatch(batchId int) (*BatchModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	batch, ok := s.batches[batchId]
+	if !ok {
+		return nil, nil
+	}
+	ret := &BatchModel{
+		Id:        batch.Id,
+		CreatedAt: batch.CreatedAt,
+		Files:     make([]BatchFileModel, 0, len(batch.Files)),
+	}
+	for _, f := range batch.Files {
+		file := s.files[f.FileId]
+		status := 0
+		if logs := s.logs[f.FileId]; len(logs) > 0 {
+			status = logs[len(logs)-1].Status
+		}
+		ret.Files = append(ret.Files, BatchFileModel{
+			FileId:   file.Id,
+			Url:      file.Url,
+			Hash:     file.Hash,
+			HashAlgo: file.HashAlgo,
+			Status:   status,
+		})
+	}
+	return ret, nil
+}
+
+// AcquireBlob links file to the existing blob of the digest and returns the blob, nil if there is no such blob.
+// File already linked to the blob isn't counted twice.
+func (s *memoryStorage) AcquireBlob(fileId int, digest string) (*BlobModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.acquireBlob(fileId, digest)
+}
+
+func (s *memoryStorage) acquireBlob(fileId int, digest string) (*BlobModel, error) {
+	file, ok := s.files[fileId]
+	if !ok {
+		return nil, fmt.Errorf("file %d doesn't exist", fileId)
+	}
+	blob, ok := s.blobs[digest]
+	if !ok {
+		return nil, nil
+	}
+	if file.BlobDigest != digest {
+		blob.Refs++
+		file.BlobDigest = digest
+		file.Location = blob.Location
+	}
+	ret := *blob
+	return &ret, nil
+}
+
+// InsertBlob links file to the blob of the model digest, blob is created if it doesn't exist yet.
+// Returns linked blob: it is not the given one if blob of the digest has been created by another file meanwhile.
+func (s *memoryStorage) InsertBlob(fileId int, model *BlobModel) (*BlobModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, err := s.acquireBlob(fileId, model.Digest)
+	if err != nil || blob != nil {
+		return blob, err
+	}
+
+	blob = &BlobModel{}
+	*blob = *model
+	blob.Refs = 1
+	s.blobs[blob.Digest] = blob
+	file := s.files[fileId]
+	file.BlobDigest = blob.Digest
+	file.Location = blob.Location
+	ret := *blob
+	return &ret, nil
+}
+
+// DeleteFile deletes file with its logs, media streams, callbacks and batch items and releases its blob.
+// Returns false if file doesn't exist or has job (queued or in progress). Returns blob if its last
+// reference is released: blob is deleted too and has to be removed from the blob store.
+func (s *memoryStorage) DeleteFile(fileId int) (bool, *BlobModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[fileId]
+	if !ok {
+		return false, nil, nil
+	}
+	for _, job := range s.jobs {
+		if job.FileId == fileId {
+			return false, nil, nil
+		}
+	}
+
+	delete(s.files, fileId)
+	delete(s.logs, fileId)
+	delete(s.mediaStreams, fileId)
+	for id, callback := range s.callbacks {
+		if callback.FileId == fileId {
+			delete(s.callbacks, id)
+		}
+	}
+	for _, batch := range s.batches {
+		files := batch.Files[:0]
+		for _, f := range batch.Files {
+			if f.FileId != fileId {
+				files = append(files, f)
+			}
+		}
+		batch.Files = files
+	}
+
+	blob, ok := s.blobs[file.BlobDigest]
+	if !ok {
+		return true, nil, nil
+	}
+	blob.Refs--
+	if blob.Refs > 0 {
+		return true, nil, nil
+	}
+	delete(s.blobs, blob.Digest)
+	return true, blob, nil
+}
+
+// claimableJobs returns available jobs with expired lease in the queue order.
+func (s *memoryStorage) claimableJobs(now, aging int64) []*JobModel {
+	ret := make([]*JobModel, 0)
+	for _, job := range s.jobs {
+		if job.LeaseUntil <= now && job.AvailableAt <= now {
+			ret = append(ret, job)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		rankI, tieI := queueRank(ret[i], aging)
+		rankJ, tieJ := queueRank(ret[j], aging)
+		if rankI != rankJ {
+			return rankI < rankJ
+		}
+		if tieI != tieJ {
+			return tieI < tieJ
+		}
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+// queueRank returns sort keys of the job in the queue: priority with aging or strict priority if aging is zero.
+func queueRank(job *JobModel, aging int64) (int64, int64) {
+	if aging > 0 {
+		return job.CreatedAt - int64(job.Priority)*aging, 0
+	}
+	return -int64(job.Priority), job.CreatedAt
+}
+
+func (s *memoryStorage) jobWithFile(job *JobModel) *JobModel {
+	ret := *job
+	if file, ok := s.files[job.FileId]; ok {
+		ret.Url = file.Url
+		ret.Hash = file.Hash
+		ret.HashAlgo = file.HashAlgo
+	}
+	return &ret
+}
+
+func (s *memoryStorage) InsertLog(model *LogModel) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logs[model.FileId] = append(s.logs[model.FileId], *model)
+	return -1, nil
+}
+
+func (s *memoryStorage) findFile(url, hash string) *FileModel {
+	for _, file := range s.files {
+		if file.Url == url && file.Hash == hash {
+			return file
+		}
+	}
+	return nil
+}
+
+// fileIds returns ids of all files in insertion order.
+func (s *memoryStorage) fileIds() []int {
+	ids := make([]int, 0, len(s.files))
+	for id := range s.files {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// statistic builds statistic of the files in the same form as sql storage does:
+// files without logs are skipped, logs of the files with the same url are merged.
+func (s *memoryStorage) statistic(files []*FileModel) Statistic {
+	ret := make(Statistic)
+	for _, file := range files {
+		logs := s.logs[file.Id]
+		if len(logs) == 0 {
+			continue
+		}
+		log := make([]map[string]string, 0, len(logs))
+		for _, l := range logs {
+			log = append(log, map[string]string{
+				"status":  StatusName(l.Status),
+				"message": l.Message,
+			})
+		}
+
+		if stat, ok := ret[file.Url]; ok {
+			stat["log"] = append(stat["log"].([]map[string]string), log...)
+			continue
+		}
+
+		stat := make(map[string]interface{}, 0)
+		stat["id"] = file.Id
+		stat["hash"] = file.Hash
+		stat["hash_algo"] = file.HashAlgo
+		stat["bitrate"] = file.BitRate
+		stat["resolution"] = file.Resolution
+		stat["location"] = file.Location
+		if file.MediaInfo != "" {
+			stat["media"] = json.RawMessage(file.MediaInfo)
+		}
+		stat["log"] = log
+
+		ret[file.Url] = stat
+	}
+	return ret
+}
@@ -0,0 +1,15 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/storage"
+	"github.com/dk13danger/media-service/storage/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		return storage.NewMemoryStorage(logrus.New())
+	})
+}
@@ -0,0 +1,522 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// migration is the numbered schema change.
+// Migrations are never edited after release: every schema change is the new migration at the end of the list.
+// Versions are the same for all dialects. Data which can't be migrated by sql is migrated by upData
+// after up within the same transaction.
+type migration struct {
+	version int
+	name    string
+	up      string
+	upData  func(tx *sql.Tx, d *dialect) error
+}
+
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// Tables may already exist in databases created by hand from the old sys/dump.sql.
+		up: `
+			CREATE TABLE IF NOT EXISTS files (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				url        VARCHAR(255) NOT NULL,
+				hash       VARCHAR(32)  NOT NULL,
+				resolution VARCHAR(20) DEFAULT '',
+				bitrate    VARCHAR(20) DEFAULT ''
+			);
+
+			CREATE TABLE IF NOT EXISTS log (
+				id      INTEGER PRIMARY KEY AUTOINCREMENT,
+				file_id INTEGER NOT NULL,
+				status  INTEGER NOT NULL,
+				message VARCHAR(300) NOT NULL
+			);
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_files_url_hash ON files (url, hash);
+		`,
+	},
+	{
+		version: 2,
+		name:    "callbacks",
+		up: `
+			ALTER TABLE files ADD COLUMN callback_url VARCHAR(255) DEFAULT '';
+
+			CREATE TABLE callbacks (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				file_id         INTEGER NOT NULL,
+				url             VARCHAR(255) NOT NULL,
+				payload         TEXT NOT NULL,
+				status          INTEGER NOT NULL,
+				attempts        INTEGER NOT NULL DEFAULT 0,
+				next_attempt_at INTEGER NOT NULL,
+				last_error      TEXT DEFAULT ''
+			);
+
+			CREATE INDEX idx_callbacks_status ON callbacks (status, next_attempt_at);
+		`,
+	},
+	{
+		version: 3,
+		name:    "files hash algorithm",
+		// SQLite doesn't limit VARCHAR length, so hash column is left as is.
+		up: `
+			ALTER TABLE files ADD COLUMN hash_algo VARCHAR(16) NOT NULL DEFAULT 'md5';
+		`,
+	},
+	{
+		version: 4,
+		name:    "files media info",
+		up: `
+			ALTER TABLE files ADD COLUMN media_info TEXT DEFAULT '';
+		`,
+	},
+	{
+		version: 5,
+		name:    "media streams",
+		up: `
+			CREATE TABLE media_streams (
+				id           INTEGER PRIMARY KEY AUTOINCREMENT,
+				file_id      INTEGER NOT NULL,
+				stream_index INTEGER NOT NULL,
+				codec_type   VARCHAR(20) NOT NULL,
+				codec_name   VARCHAR(50) DEFAULT '',
+				width        INTEGER DEFAULT 0,
+				height       INTEGER DEFAULT 0,
+				bit_rate     INTEGER DEFAULT 0,
+				duration     REAL DEFAULT 0,
+				language     VARCHAR(20) DEFAULT ''
+			);
+
+			CREATE UNIQUE INDEX idx_media_streams_file_stream ON media_streams (file_id, stream_index);
+			CREATE INDEX idx_media_streams_codec ON media_streams (codec_type, codec_name, height);
+		`,
+	},
+	{
+		version: 6,
+		name:    "jobs",
+		// Files which were interrupted before the jobs queue appeared (last log status is neither
+		// failed nor completed) are queued again.
+		up: `
+			CREATE TABLE jobs (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				file_id     INTEGER NOT NULL,
+				owner       VARCHAR(255) NOT NULL DEFAULT '',
+				lease_until INTEGER NOT NULL DEFAULT 0,
+				claims      INTEGER NOT NULL DEFAULT 0,
+				created_at  INTEGER NOT NULL
+			);
+
+			CREATE UNIQUE INDEX idx_jobs_file ON jobs (file_id);
+			CREATE INDEX idx_jobs_lease ON jobs (lease_until);
+
+			INSERT INTO jobs(file_id, created_at)
+			SELECT f.id, CAST(strftime('%s', 'now') AS INTEGER)
+			  FROM files f
+			 WHERE COALESCE((SELECT l.status FROM log l WHERE l.file_id = f.id ORDER BY l.id DESC LIMIT 1), 0)
+			       NOT IN (3, 4)
+			 ORDER BY f.id;
+		`,
+	},
+	{
+		version: 7,
+		name:    "jobs priority",
+		up: `
+			ALTER TABLE jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 2;
+		`,
+	},
+	{
+		version: 8,
+		name:    "jobs cancellation",
+		up: `
+			ALTER TABLE jobs ADD COLUMN cancelled INTEGER NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		version: 9,
+		name:    "batches",
+		up: `
+			CREATE TABLE batches (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				created_at INTEGER NOT NULL
+			);
+
+			CREATE TABLE batch_files (
+				batch_id   INTEGER NOT NULL,
+				item_index INTEGER NOT NULL,
+				file_id    INTEGER NOT NULL,
+				PRIMARY KEY (batch_id, item_index)
+			);
+		`,
+	},
+	{
+		version: 10,
+		name:    "jobs retries",
+		up: `
+			ALTER TABLE jobs ADD COLUMN available_at INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		version: 11,
+		name:    "files location",
+		up: `
+			ALTER TABLE files ADD COLUMN location TEXT NOT NULL DEFAULT '';
+		`,
+	},
+	{
+		version: 12,
+		name:    "blobs",
+		up: `
+			CREATE TABLE blobs (
+				digest     VARCHAR(255) PRIMARY KEY,
+				blob_key   TEXT         NOT NULL,
+				location   TEXT         NOT NULL,
+				media_info TEXT         NOT NULL DEFAULT '',
+				refs       INTEGER      NOT NULL DEFAULT 0,
+				created_at INTEGER      NOT NULL
+			);
+
+			ALTER TABLE files ADD COLUMN blob_digest VARCHAR(255) NOT NULL DEFAULT '';
+			CREATE INDEX files_blob_digest ON files(blob_digest);
+		`,
+	},
+	{
+		version: 13,
+		name:    "unlimited urls and messages",
+		// SQLite doesn't enforce length of VARCHAR columns.
+		up: `SELECT 1`,
+	},
+	{
+		version: 14,
+		name:    "jobs host",
+		up: `
+			ALTER TABLE jobs ADD COLUMN host VARCHAR(255) NOT NULL DEFAULT '';
+		`,
+	},
+	{
+		version: 15,
+		name:    "callbacks lease",
+		up: `
+			ALTER TABLE callbacks ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT '';
+			ALTER TABLE callbacks ADD COLUMN lease_until INTEGER NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		version: 16,
+		name:    "jobs host backfill",
+		upData:  backfillJobHosts,
+	},
+}
+
+var postgresMigrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: `
+			CREATE TABLE IF NOT EXISTS files (
+				id         SERIAL PRIMARY KEY,
+				url        VARCHAR(255) NOT NULL,
+				hash       VARCHAR(32)  NOT NULL,
+				resolution VARCHAR(20) DEFAULT '',
+				bitrate    VARCHAR(20) DEFAULT ''
+			);
+
+			CREATE TABLE IF NOT EXISTS log (
+				id      SERIAL PRIMARY KEY,
+				file_id INTEGER NOT NULL,
+				status  INTEGER NOT NULL,
+				message VARCHAR(300) NOT NULL
+			);
+
+			CREATE UNIQUE INDEX IF NOT EXISTS idx_files_url_hash ON files (url, hash);
+		`,
+	},
+	{
+		version: 2,
+		name:    "callbacks",
+		up: `
+			ALTER TABLE files ADD COLUMN callback_url VARCHAR(255) DEFAULT '';
+
+			CREATE TABLE callbacks (
+				id              SERIAL PRIMARY KEY,
+				file_id         INTEGER NOT NULL,
+				url             VARCHAR(255) NOT NULL,
+				payload         TEXT NOT NULL,
+				status          INTEGER NOT NULL,
+				attempts        INTEGER NOT NULL DEFAULT 0,
+				next_attempt_at BIGINT NOT NULL,
+				last_error      TEXT DEFAULT ''
+			);
+
+			CREATE INDEX idx_callbacks_status ON callbacks (status, next_attempt_at);
+		`,
+	},
+	{
+		version: 3,
+		name:    "files hash algorithm",
+		up: `
+			ALTER TABLE files ALTER COLUMN hash TYPE VARCHAR(128);
+			ALTER TABLE files ADD COLUMN hash_algo VARCHAR(16) NOT NULL DEFAULT 'md5';
+		`,
+	},
+	{
+		version: 4,
+		name:    "files media info",
+		up: `
+			ALTER TABLE files ADD COLUMN media_info TEXT DEFAULT '';
+		`,
+	},
+	{
+		version: 5,
+		name:    "media streams",
+		up: `
+			CREATE TABLE media_streams (
+				id           SERIAL PRIMARY KEY,
+				file_id      INTEGER NOT NULL,
+				stream_index INTEGER NOT NULL,
+				codec_type   VARCHAR(20) NOT NULL,
+				codec_name   VARCHAR(50) DEFAULT '',
+				width        INTEGER DEFAULT 0,
+				height       INTEGER DEFAULT 0,
+				bit_rate     BIGINT DEFAULT 0,
+				duration     DOUBLE PRECISION DEFAULT 0,
+				language     VARCHAR(20) DEFAULT ''
+			);
+
+			CREATE UNIQUE INDEX idx_media_streams_file_stream ON media_streams (file_id, stream_index);
+			CREATE INDEX idx_media_streams_codec ON media_streams (codec_type, codec_name, height);
+		`,
+	},
+	{
+		version: 6,
+		name:    "jobs",
+		up: `
+			CREATE TABLE jobs (
+				id          SERIAL PRIMARY KEY,
+				file_id     INTEGER NOT NULL,
+				owner       VARCHAR(255) NOT NULL DEFAULT '',
+				lease_until BIGINT NOT NULL DEFAULT 0,
+				claims      INTEGER NOT NULL DEFAULT 0,
+				created_at  BIGINT NOT NULL
+			);
+
+			CREATE UNIQUE INDEX idx_jobs_file ON jobs (file_id);
+			CREATE INDEX idx_jobs_lease ON jobs (lease_until);
+
+			INSERT INTO jobs(file_id, created_at)
+			SELECT f.id, CAST(EXTRACT(EPOCH FROM NOW()) AS BIGINT)
+			  FROM files f
+			 WHERE COALESCE((SELECT l.status FROM log l WHERE l.file_id = f.id ORDER BY l.id DESC LIMIT 1), 0)
+			       NOT IN (3, 4)
+			 ORDER BY f.id;
+		`,
+	},
+	{
+		version: 7,
+		name:    "jobs priority",
+		up: `
+			ALTER TABLE jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 2;
+		`,
+	},
+	{
+		version: 8,
+		name:    "jobs cancellation",
+		up: `
+			ALTER TABLE jobs ADD COLUMN cancelled INTEGER NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		version: 9,
+		name:    "batches",
+		up: `
+			CREATE TABLE batches (
+				id         SERIAL PRIMARY KEY,
+				created_at BIGINT NOT NULL
+			);
+
+			CREATE TABLE batch_files (
+				batch_id   INTEGER NOT NULL,
+				item_index INTEGER NOT NULL,
+				file_id    INTEGER NOT NULL,
+				PRIMARY KEY (batch_id, item_index)
+			);
+		`,
+	},
+	{
+		version: 10,
+		name:    "jobs retries",
+		up: `
+			ALTER TABLE jobs ADD COLUMN available_at BIGINT NOT NULL DEFAULT 0;
+			ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		version: 11,
+		name:    "files location",
+		up: `
+			ALTER TABLE files ADD COLUMN location TEXT NOT NULL DEFAULT '';
+		`,
+	},
+	{
+		version: 12,
+		name:    "blobs",
+		up: `
+			CREATE TABLE blobs (
+				digest     VARCHAR(255) PRIMARY KEY,
+				blob_key   TEXT         NOT NULL,
+				location   TEXT         NOT NULL,
+				media_info TEXT         NOT NULL DEFAULT '',
+				refs       INTEGER      NOT NULL DEFAULT 0,
+				created_at BIGINT       NOT NULL
+			);
+
+			ALTER TABLE files ADD COLUMN blob_digest VARCHAR(255) NOT NULL DEFAULT '';
+			CREATE INDEX files_blob_digest ON files(blob_digest);
+		`,
+	},
+	{
+		version: 13,
+		name:    "unlimited urls and messages",
+		up: `
+			ALTER TABLE files ALTER COLUMN url TYPE TEXT;
+			ALTER TABLE files ALTER COLUMN callback_url TYPE TEXT;
+			ALTER TABLE log ALTER COLUMN message TYPE TEXT;
+			ALTER TABLE callbacks ALTER COLUMN url TYPE TEXT;
+		`,
+	},
+	{
+		version: 14,
+		name:    "jobs host",
+		up: `
+			ALTER TABLE jobs ADD COLUMN host VARCHAR(255) NOT NULL DEFAULT '';
+		`,
+	},
+	{
+		version: 15,
+		name:    "callbacks lease",
+		up: `
+			ALTER TABLE callbacks ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT '';
+			ALTER TABLE callbacks ADD COLUMN lease_until BIGINT NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		version: 16,
+		name:    "jobs host backfill",
+		upData:  backfillJobHosts,
+	},
+}
+
+// migrationsLockId is the key of the advisory lock which serializes migrations of service replicas.
+const migrationsLockId = 7355608
+
+// migrate applies pending migrations of the dialect, each one within its own transaction.
+// Migrations are applied by one connection holding the lock (if dialect supports advisory locks),
+// so replicas started together wait for each other and current version is read under the lock.
+func migrate(logger *logrus.Logger, db *sql.DB, d *dialect) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if d.advisoryLocks {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationsLockId); err != nil {
+			return fmt.Errorf("can't lock migrations: %v", err)
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationsLockId)
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       VARCHAR(255) NOT NULL,
+			applied_at BIGINT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("can't create schema_migrations table: %v", err)
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("can't get current schema version: %v", err)
+	}
+
+	for _, m := range d.migrations {
+		if m.version <= current {
+			continue
+		}
+		logger.Infof("Applying migration #%d (%s)", m.version, m.name)
+		if err := applyMigration(ctx, conn, d, m); err != nil {
+			return fmt.Errorf("can't apply migration #%d (%s): %v", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, d *dialect, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if m.up != "" {
+		if _, err := tx.Exec(m.up); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if m.upData != nil {
+		if err := m.upData(tx, d); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		d.rebind("INSERT INTO schema_migrations(version, name, applied_at) VALUES (?,?,?)"),
+		m.version, m.name, time.Now().Unix(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// backfillJobHosts sets hosts of jobs queued before hosts were stored, so they are limited by host limits too.
+func backfillJobHosts(tx *sql.Tx, d *dialect) error {
+	rows, err := tx.Query("SELECT j.id, f.url FROM jobs j JOIN files f ON f.id = j.file_id WHERE j.host = ''")
+	if err != nil {
+		return err
+	}
+	hosts := make(map[int]string)
+	for rows.Next() {
+		var jobId int
+		var url string
+		if err := rows.Scan(&jobId, &url); err != nil {
+			rows.Close()
+			return err
+		}
+		hosts[jobId] = UrlHost(url)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for jobId, host := range hosts {
+		if _, err := tx.Exec(d.rebind("UPDATE jobs SET host=? WHERE id=?"), host, jobId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
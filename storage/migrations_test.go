@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// TestBackfillJobHosts checks that jobs queued before hosts were stored get hosts of their files.
+func TestBackfillJobHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media-service-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", sqliteDsn(filepath.Join(dir, "media.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	var old []migration
+	for _, m := range sqliteMigrations {
+		if m.upData == nil {
+			old = append(old, m)
+			continue
+		}
+		break
+	}
+	if err := migrate(logger, db, &dialect{name: DRIVER_SQLITE, migrations: old}); err != nil {
+		t.Fatalf("migrate() before backfill: %v", err)
+	}
+	urls := map[int]string{1: "http://Example.com:8080/a.mp4", 2: "https://cdn.host/b.mp4", 3: "http://[::1]:80/c.mp4"}
+	for id, url := range urls {
+		if _, err := db.Exec("INSERT INTO files(id, url, hash) VALUES (?,?,?)", id, url, "hash"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO jobs(file_id, created_at) VALUES (?,?)", id, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrate(logger, db, sqliteDialect); err != nil {
+		t.Fatalf("migrate(): %v", err)
+	}
+	want := map[int]string{1: "example.com", 2: "cdn.host", 3: "::1"}
+	for fileId, host := range want {
+		var current string
+		if err := db.QueryRow("SELECT host FROM jobs WHERE file_id=?", fileId).Scan(&current); err != nil || current != host {
+			t.Errorf("host of job of file %d = %q, %v; want %q", fileId, current, err, host)
+		}
+	}
+}
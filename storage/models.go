@@ -1,22 +1,209 @@
 package storage
 
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
 const (
 	STATUS_PENDING   = 1
 	STATUS_ERROR     = 2
 	STATUS_FAILED    = 3
 	STATUS_COMPLETED = 4
+	STATUS_CANCELLED = 5
+)
+
+const (
+	PRIORITY_LOW    = 1
+	PRIORITY_NORMAL = 2
+	PRIORITY_HIGH   = 3
 )
 
+const (
+	CALLBACK_PENDING   = 1
+	CALLBACK_DELIVERED = 2
+	CALLBACK_FAILED    = 3
+)
+
+// FileModel describes remote file, MediaInfo is JSON encoded info about media streams.
+// Location is the location of the stored media file, empty until file is processed.
+// BlobDigest is the digest of the blob which file is linked to, empty if file isn't linked.
 type FileModel struct {
-	Id         int
-	Url        string
-	Hash       string
-	Resolution string
-	BitRate    string
+	Id          int
+	Url         string
+	Hash        string
+	HashAlgo    string
+	Resolution  string
+	BitRate     string
+	MediaInfo   string
+	CallbackUrl string
+	Location    string
+	BlobDigest  string
+}
+
+// BlobModel is the stored media file shared by files with the same content. Digest is "<algorithm>:<hash>",
+// Key is the key of the file in the blob store, MediaInfo is JSON encoded info about media streams,
+// Refs is the count of files linked to the blob.
+type BlobModel struct {
+	Digest    string
+	Key       string
+	Location  string
+	MediaInfo string
+	Refs      int
+	CreatedAt int64
 }
 
+// Statistic contains files info with its log history grouped by url.
+type Statistic map[string]map[string]interface{}
+
 type LogModel struct {
 	FileId  int
 	Status  int
 	Message string
 }
+
+// MediaStreamModel describes one stream of the media file.
+// BitRate is in bits per second, Duration is in seconds.
+type MediaStreamModel struct {
+	FileId    int
+	Index     int
+	CodecType string
+	CodecName string
+	Width     int
+	Height    int
+	BitRate   int64
+	Duration  float64
+	Language  string
+}
+
+// MediaStreamFilter selects files which have at least one stream matched by all non-zero fields.
+type MediaStreamFilter struct {
+	CodecType  string
+	CodecName  string
+	Width      int
+	Height     int
+	MinBitRate int64
+	Language   string
+}
+
+func (f *MediaStreamFilter) match(m *MediaStreamModel) bool {
+	return (f.CodecType == "" || f.CodecType == m.CodecType) &&
+		(f.CodecName == "" || f.CodecName == m.CodecName) &&
+		(f.Width <= 0 || f.Width == m.Width) &&
+		(f.Height <= 0 || f.Height == m.Height) &&
+		(f.MinBitRate <= 0 || m.BitRate >= f.MinBitRate) &&
+		(f.Language == "" || f.Language == m.Language)
+}
+
+// CallbackModel is a webhook delivery of the task final status.
+// NextAttemptAt is unix timestamp of the next delivery attempt.
+// Callback is delivered by the notifier which leased it: Owner and LeaseUntil (unix timestamp) are like in JobModel.
+type CallbackModel struct {
+	Id            int
+	FileId        int
+	Url           string
+	Payload       string
+	Status        int
+	Attempts      int
+	NextAttemptAt int64
+	LastError     string
+	Owner         string
+	LeaseUntil    int64
+}
+
+// JobModel is the queued downloading of the file (joined with the file info).
+// Job is claimable when its lease is expired and it is available: LeaseUntil and AvailableAt are unix timestamps,
+// zero for never claimed (or retried) job. Claims is the count of times job was claimed by workers,
+// Attempts is the count of failed attempts, job is retried after AvailableAt.
+// Cancelled job is still leased by its worker until worker aborts it.
+// Host is the host of the file url (see UrlHost).
+type JobModel struct {
+	Id          int
+	FileId      int
+	Host        string
+	Url         string
+	Hash        string
+	HashAlgo    string
+	Priority    int
+	Owner       string
+	LeaseUntil  int64
+	AvailableAt int64
+	Claims      int
+	Attempts    int
+	Cancelled   bool
+	CreatedAt   int64
+}
+
+// JobsCount contains count of jobs waiting in the queue by priority (including delayed ones),
+// count of jobs delayed till their next attempt and count of jobs leased by workers.
+type JobsCount struct {
+	Queued  map[int]int
+	Delayed int
+	Leased  int
+}
+
+// BatchModel is a group of files submitted at once. Files are ordered as they were submitted.
+type BatchModel struct {
+	Id        int
+	CreatedAt int64
+	Files     []BatchFileModel
+}
+
+// BatchFileModel is the file of the batch with its last log status, zero if file has no log records yet.
+type BatchFileModel struct {
+	FileId   int
+	Url      string
+	Hash     string
+	HashAlgo string
+	Status   int
+}
+
+// StatusName returns human readable name of the log status.
+func StatusName(status int) string {
+	switch status {
+	case STATUS_PENDING:
+		return "pending"
+	case STATUS_COMPLETED:
+		return "completed"
+	case STATUS_FAILED:
+		return "failed"
+	case STATUS_ERROR:
+		return "error"
+	case STATUS_CANCELLED:
+		return "cancelled"
+	}
+	return "not defined"
+}
+
+// PriorityName returns human readable name of the job priority.
+func PriorityName(priority int) string {
+	switch priority {
+	case PRIORITY_LOW:
+		return "low"
+	case PRIORITY_NORMAL:
+		return "normal"
+	case PRIORITY_HIGH:
+		return "high"
+	}
+	return "not defined"
+}
+
+// UrlHost returns lower cased host of the url (without port), empty string if url can't be parsed.
+func UrlHost(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// ParsePriority returns job priority by its name.
+func ParsePriority(name string) (int, error) {
+	for _, priority := range []int{PRIORITY_LOW, PRIORITY_NORMAL, PRIORITY_HIGH} {
+		if PriorityName(priority) == name {
+			return priority, nil
+		}
+	}
+	return 0, fmt.Errorf("priority %q is not supported, use one of: low, normal, high", name)
+}
@@ -0,0 +1,62 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/storage"
+	"github.com/dk13danger/media-service/storage/storagetest"
+)
+
+// postgresDsnEnv names environment variable with dsn of the test database,
+// e.g. "postgres://postgres@localhost/media_test?sslmode=disable". Tests are skipped if it isn't set
+// (generated SQL is still checked by TestPostgresQueries without database).
+const postgresDsnEnv = "MEDIA_SERVICE_TEST_POSTGRES_DSN"
+
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv(postgresDsnEnv)
+	if dsn == "" {
+		t.Skipf("%s isn't set", postgresDsnEnv)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every storage gets its own schema, so tests don't see data of each other.
+	prefix := fmt.Sprintf("storagetest_%d", time.Now().UnixNano())
+	var schemas []string
+	defer func() {
+		for _, schema := range schemas {
+			if _, err := db.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+				t.Errorf("Can't drop schema %q: %v", schema, err)
+			}
+		}
+	}()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		schema := fmt.Sprintf("%s_%d", prefix, len(schemas))
+		if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+			t.Fatal(err)
+		}
+		schemas = append(schemas, schema)
+		return storage.NewPostgresStorage(logrus.New(), withSearchPath(dsn, schema))
+	})
+}
+
+// withSearchPath adds search_path run-time parameter to the url or key/value dsn.
+func withSearchPath(dsn, schema string) string {
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&search_path=" + schema
+	}
+	return dsn + "?search_path=" + schema
+}
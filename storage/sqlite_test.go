@@ -0,0 +1,52 @@
+package storage_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/storage"
+	"github.com/dk13danger/media-service/storage/storagetest"
+)
+
+func TestSqliteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media-service-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	count := 0
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		count++
+		return storage.NewSqliteStorage(logrus.New(), filepath.Join(dir, fmt.Sprintf("%d.db", count)))
+	})
+}
+
+// TestSqliteMigrations checks that reopening of the migrated db doesn't apply migrations again.
+func TestSqliteMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media-service-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "media.db")
+	s := storage.NewSqliteStorage(logrus.New(), dbPath)
+	id, err := s.InsertFile(&storage.FileModel{Url: "http://example.com/a.mp4", Hash: "hash-a", HashAlgo: "md5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = storage.NewSqliteStorage(logrus.New(), dbPath)
+	file, err := s.SelectFileById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil || file.Url != "http://example.com/a.mp4" {
+		t.Fatalf("file %d isn't kept after reopening: %+v", id, file)
+	}
+}
@@ -0,0 +1,1313 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dk13danger/media-service/config"
+)
+
+const (
+	DRIVER_SQLITE   = "sqlite"
+	DRIVER_POSTGRES = "postgres"
+	DRIVER_MEMORY   = "memory"
+)
+
+// storage is the sql implementation of Storager, database specifics are hidden by dialect.
+type storage struct {
+	logger                   *logrus.Logger
+	db                       *sql.DB
+	dialect                  *dialect
+	insertFileStmt           *sql.Stmt
+	insertCallbackStmt       *sql.Stmt
+	insertLogStmt            *sql.Stmt
+	selectFilesStmt          *sql.Stmt
+	selectFilesByUrlStmt     *sql.Stmt
+	selectFileStmt           *sql.Stmt
+	selectFileByIdStmt       *sql.Stmt
+	selectLogsStmt           *sql.Stmt
+	updateFileStmt           *sql.Stmt
+	updateFileCallbackStmt   *sql.Stmt
+	updateCallbackStmt       *sql.Stmt
+	selectCallbacksStmt      *sql.Stmt
+	selectCallbackStmt       *sql.Stmt
+	selectDueCallbackStmt    *sql.Stmt
+	claimCallbackStmt        *sql.Stmt
+	insertMediaStreamStmt    *sql.Stmt
+	deleteMediaStreamsStmt   *sql.Stmt
+	selectMediaStreamsStmt   *sql.Stmt
+	checkFileIsCompletedStmt *sql.Stmt
+	insertJobStmt            *sql.Stmt
+	selectJobStmt            *sql.Stmt
+	selectJobByFileStmt      *sql.Stmt
+	raiseJobPriorityStmt     *sql.Stmt
+	selectClaimableJobStmt   *sql.Stmt
+	claimJobStmt             *sql.Stmt
+	extendJobStmt            *sql.Stmt
+	deleteJobStmt            *sql.Stmt
+	selectJobPositionStmt    *sql.Stmt
+	deleteQueuedJobStmt      *sql.Stmt
+	cancelJobStmt            *sql.Stmt
+	countJobsStmt            *sql.Stmt
+	insertBatchStmt          *sql.Stmt
+	insertBatchFileStmt      *sql.Stmt
+	selectBatchStmt          *sql.Stmt
+	selectBatchFilesStmt     *sql.Stmt
+	retryJobStmt             *sql.Stmt
+	deferJobStmt             *sql.Stmt
+	selectDelayedJobsStmt    *sql.Stmt
+	selectBlobStmt           *sql.Stmt
+	insertBlobStmt           *sql.Stmt
+	refBlobStmt              *sql.Stmt
+	unrefBlobStmt            *sql.Stmt
+	deleteBlobStmt           *sql.Stmt
+	selectFileBlobStmt       *sql.Stmt
+	linkFileBlobStmt         *sql.Stmt
+	deleteFileStmts          []*sql.Stmt
+}
+
+type Storager interface {
+	CheckFileIsCompleted(fileId int) (bool, error)
+	GetStatistic() (Statistic, error)
+	GetStatisticByUrl(url, hash string) (Statistic, error)
+	InsertLog(model *LogModel) (int, error)
+	InsertFile(model *FileModel) (int, error)
+	InsertCallback(model *CallbackModel) (int, error)
+	InsertMediaStreams(fileId int, streams []MediaStreamModel) error
+	SelectFile(url, hash string) (int, error)
+	SelectFileById(fileId int) (*FileModel, error)
+	SelectLogs(fileId int) ([]LogModel, error)
+	SelectMediaStreams(fileId int) ([]MediaStreamModel, error)
+	SelectFilesByMediaStream(filter *MediaStreamFilter) ([]FileModel, error)
+	UpdateFile(model *FileModel) (int, error)
+	UpdateFileCallback(fileId int, callbackUrl string) error
+	UpdateCallback(model *CallbackModel) (int, error)
+	SelectPendingCallbacks(until int64) ([]CallbackModel, error)
+	ClaimCallback(owner string, now, leaseUntil int64) (*CallbackModel, error)
+	EnqueueFile(model *FileModel, priority int, now int64) (int, error)
+	ClaimJob(owner string, now, leaseUntil, aging int64, skipHosts []string) (*JobModel, error)
+	SelectJob(jobId int) (*JobModel, error)
+	ExtendJob(jobId int, owner string, leaseUntil int64) (bool, error)
+	DeleteJob(jobId int, owner string) error
+	DeleteQueuedJob(fileId int, now int64) (bool, error)
+	CancelJob(fileId int, now int64) (bool, error)
+	SelectJobPosition(fileId int, now, aging int64) (int, error)
+	CountJobs(now int64) (*JobsCount, error)
+	RetryJob(jobId int, owner string, availableAt int64) (bool, error)
+	DeferJob(jobId int, owner string, availableAt int64) (bool, error)
+	SelectDelayedJobs(now int64) ([]JobModel, error)
+	EnqueueBatch(models []*FileModel, priority int, now int64) (int, []int, error)
+	SelectBatch(batchId int) (*BatchModel, error)
+	AcquireBlob(fileId int, digest string) (*BlobModel, error)
+	InsertBlob(fileId int, model *BlobModel) (*BlobModel, error)
+	DeleteFile(fileId int) (bool, *BlobModel, error)
+}
+
+// New creates storage by configured driver.
+// Panics if driver is not supported or any operations fail.
+func New(logger *logrus.Logger, cfg *config.Storage) Storager {
+	switch cfg.Driver {
+	case DRIVER_SQLITE, "":
+		return NewSqliteStorage(logger, cfg.Dsn)
+	case DRIVER_POSTGRES:
+		return NewPostgresStorage(logger, cfg.Dsn)
+	case DRIVER_MEMORY:
+		return NewMemoryStorage(logger)
+	}
+	panic(fmt.Sprintf("Storage driver %q is not supported", cfg.Driver))
+}
+
+func (s *storage) CheckFileIsCompleted(fileId int) (bool, error) {
+	rows, err := s.checkFileIsCompletedStmt.Query(fileId)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var id int
+	for rows.Next() {
+		if err = rows.Scan(&id); err == nil {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+func (s *storage) SelectFile(url, hash string) (int, error) {
+	rows, err := s.selectFileStmt.Query(url, hash)
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+
+	var id int
+	for rows.Next() {
+		if err = rows.Scan(&id); err != nil {
+			return -1, err
+		} else {
+			return id, nil
+		}
+	}
+	return -1, nil
+}
+
+func (s *storage) SelectFileById(fileId int) (*FileModel, error) {
+	rows, err := s.selectFileByIdStmt.Query(fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file := &FileModel{}
+		err = rows.Scan(
+			&file.Id, &file.Url, &file.Hash, &file.HashAlgo, &file.BitRate, &file.Resolution, &file.MediaInfo, &file.CallbackUrl,
+			&file.Location, &file.BlobDigest,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	return nil, nil
+}
+
+func (s *storage) SelectLogs(fileId int) ([]LogModel, error) {
+	rows, err := s.selectLogsStmt.Query(fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var status int
+	var message string
+	ret := make([]LogModel, 0)
+
+	for rows.Next() {
+		if err = rows.Scan(&status, &message); err != nil {
+			return nil, err
+		}
+		ret = append(ret, LogModel{
+			FileId:  fileId,
+			Status:  status,
+			Message: message,
+		})
+	}
+	return ret, nil
+}
+
+func (s *storage) GetStatisticByUrl(url, hash string) (Statistic, error) {
+	return getStatistic(s.selectFilesByUrlStmt, url, hash)
+}
+
+func (s *storage) GetStatistic() (Statistic, error) {
+	return getStatistic(s.selectFilesStmt)
+}
+
+func (s *storage) InsertFile(model *FileModel) (int, error) {
+	return s.dialect.insert(
+		s.insertFileStmt,
+		model.Url, model.Hash, model.HashAlgo, model.Resolution, model.BitRate, model.CallbackUrl,
+	)
+}
+
+func (s *storage) UpdateFile(model *FileModel) (int, error) {
+	_, err := s.updateFileStmt.Exec(model.BitRate, model.Resolution, model.MediaInfo, model.Location, model.Id)
+	if err != nil {
+		return -1, err
+	}
+	return model.Id, err
+}
+
+func (s *storage) UpdateFileCallback(fileId int, callbackUrl string) error {
+	_, err := s.updateFileCallbackStmt.Exec(callbackUrl, fileId)
+	return err
+}
+
+func (s *storage) InsertCallback(model *CallbackModel) (int, error) {
+	return s.dialect.insert(
+		s.insertCallbackStmt,
+		model.FileId, model.Url, model.Payload, model.Status, model.Attempts, model.NextAttemptAt, model.LastError,
+	)
+}
+
+func (s *storage) UpdateCallback(model *CallbackModel) (int, error) {
+	_, err := s.updateCallbackStmt.Exec(model.Status, model.Attempts, model.NextAttemptAt, model.LastError, model.Id)
+	if err != nil {
+		return -1, err
+	}
+	return model.Id, err
+}
+
+func (s *storage) SelectPendingCallbacks(until int64) ([]CallbackModel, error) {
+	rows, err := s.selectCallbacksStmt.Query(CALLBACK_PENDING, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]CallbackModel, 0)
+	for rows.Next() {
+		c := CallbackModel{}
+		err = rows.Scan(
+			&c.Id, &c.FileId, &c.Url, &c.Payload, &c.Status, &c.Attempts, &c.NextAttemptAt, &c.LastError,
+			&c.Owner, &c.LeaseUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// ClaimCallback leases the first pending callback, which is due and isn't leased, to the owner until leaseUntil,
+// so the callback is delivered by one notifier of service replicas at a time.
+// Returns nil if there are no callbacks to deliver.
+func (s *storage) ClaimCallback(owner string, now, leaseUntil int64) (*CallbackModel, error) {
+	for {
+		var callbackId int
+		err := s.selectDueCallbackStmt.QueryRow(CALLBACK_PENDING, now, now).Scan(&callbackId)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		claimed, err := affected(s.claimCallbackStmt.Exec(owner, leaseUntil, callbackId, CALLBACK_PENDING, now, now))
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			continue
+		}
+		c := &CallbackModel{}
+		err = s.selectCallbackStmt.QueryRow(callbackId).Scan(
+			&c.Id, &c.FileId, &c.Url, &c.Payload, &c.Status, &c.Attempts, &c.NextAttemptAt, &c.LastError,
+			&c.Owner, &c.LeaseUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// InsertMediaStreams replaces all streams of the file within one transaction.
+func (s *storage) InsertMediaStreams(fileId int, streams []MediaStreamModel) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Stmt(s.deleteMediaStreamsStmt).Exec(fileId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	insertStmt := tx.Stmt(s.insertMediaStreamStmt)
+	for _, m := range streams {
+		_, err = insertStmt.Exec(
+			fileId, m.Index, m.CodecType, m.CodecName, m.Width, m.Height, m.BitRate, m.Duration, m.Language,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *storage) SelectMediaStreams(fileId int) ([]MediaStreamModel, error) {
+	rows, err := s.selectMediaStreamsStmt.Query(fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]MediaStreamModel, 0)
+	for rows.Next() {
+		m := MediaStreamModel{}
+		err = rows.Scan(
+			&m.FileId, &m.Index, &m.CodecType, &m.CodecName, &m.Width, &m.Height, &m.BitRate, &m.Duration, &m.Language,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (s *storage) SelectFilesByMediaStream(filter *MediaStreamFilter) ([]FileModel, error) {
+	query, args := buildMediaStreamQuery(filter)
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]FileModel, 0)
+	for rows.Next() {
+		file := FileModel{}
+		err = rows.Scan(&file.Id, &file.Url, &file.Hash, &file.HashAlgo, &file.BitRate, &file.Resolution, &file.Location)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, file)
+	}
+	return ret, nil
+}
+
+// buildMediaStreamQuery builds query by non-zero fields of the filter.
+func buildMediaStreamQuery(filter *MediaStreamFilter) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	args := make([]interface{}, 0)
+	if filter.CodecType != "" {
+		conditions = append(conditions, "m.codec_type = ?")
+		args = append(args, filter.CodecType)
+	}
+	if filter.CodecName != "" {
+		conditions = append(conditions, "m.codec_name = ?")
+		args = append(args, filter.CodecName)
+	}
+	if filter.Width > 0 {
+		conditions = append(conditions, "m.width = ?")
+		args = append(args, filter.Width)
+	}
+	if filter.Height > 0 {
+		conditions = append(conditions, "m.height = ?")
+		args = append(args, filter.Height)
+	}
+	if filter.MinBitRate > 0 {
+		conditions = append(conditions, "m.bit_rate >= ?")
+		args = append(args, filter.MinBitRate)
+	}
+	if filter.Language != "" {
+		conditions = append(conditions, "m.language = ?")
+		args = append(args, filter.Language)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT DISTINCT f.id, f.url, f.hash, f.hash_algo, f.bitrate, f.resolution, f.location
+		  FROM files f
+		  JOIN media_streams m
+		    ON m.file_id = f.id
+		 WHERE %s
+		 ORDER BY f.id
+	`, strings.Join(conditions, " AND "))
+	return query, args
+}
+
+// EnqueueFile inserts file (or updates callback url of the existing one) and queues job
+// for it within one transaction. File has at most one queued job, its priority is raised if needed.
+func (s *storage) EnqueueFile(model *FileModel, priority int, now int64) (int, error) {
+	tx, err := s.dialect.beginWrite(s.db)
+	if err != nil {
+		return -1, err
+	}
+	fileId, err := s.enqueueFile(tx, model, priority, now)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	return fileId, tx.Commit()
+}
+
+func (s *storage) enqueueFile(tx *sql.Tx, model *FileModel, priority int, now int64) (int, error) {
+	fileId := -1
+	err := tx.Stmt(s.selectFileStmt).QueryRow(model.Url, model.Hash).Scan(&fileId)
+	switch {
+	case err == sql.ErrNoRows:
+		fileId, err = s.dialect.insert(
+			tx.Stmt(s.insertFileStmt),
+			model.Url, model.Hash, model.HashAlgo, model.Resolution, model.BitRate, model.CallbackUrl,
+		)
+		if err != nil {
+			return -1, err
+		}
+	case err != nil:
+		return -1, err
+	case model.CallbackUrl != "":
+		if _, err = tx.Stmt(s.updateFileCallbackStmt).Exec(model.CallbackUrl, fileId); err != nil {
+			return -1, err
+		}
+	}
+
+	var jobId int
+	err = tx.Stmt(s.selectJobByFileStmt).QueryRow(fileId).Scan(&jobId)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = s.dialect.insert(tx.Stmt(s.insertJobStmt), fileId, UrlHost(model.Url), priority, now)
+	case err == nil:
+		_, err = tx.Stmt(s.raiseJobPriorityStmt).Exec(priority, jobId, priority)
+	}
+	if err != nil {
+		return -1, err
+	}
+	return fileId, nil
+}
+
+// ClaimJob leases the first claimable (not leased and available) job to the owner until leaseUntil.
+// Jobs are ordered by priority with aging: waiting for aging seconds is equal to one priority level,
+// so low priority jobs aren't starved. Zero aging means strict priority (jobs of the same priority
+// are ordered by creation time). Jobs of skipHosts are left in the queue.
+// Returns nil if there are no claimable jobs.
+func (s *storage) ClaimJob(owner string, now, leaseUntil, aging int64, skipHosts []string) (*JobModel, error) {
+	// Job is claimed by conditional update, so the same job can't be claimed by concurrent workers:
+	// the loser just tries the next one.
+	for {
+		var jobId int
+		err := s.selectClaimableJob(now, aging, skipHosts).Scan(&jobId)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		claimed, err := affected(s.claimJobStmt.Exec(owner, leaseUntil, jobId, now, now))
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return s.SelectJob(jobId)
+		}
+	}
+}
+
+// selectClaimableJob queries id of the first claimable job. Query which skips hosts
+// depends on their count, so it isn't prepared.
+func (s *storage) selectClaimableJob(now, aging int64, skipHosts []string) *sql.Row {
+	if len(skipHosts) == 0 {
+		return s.selectClaimableJobStmt.QueryRow(now, now, aging, aging, aging)
+	}
+
+	args := []interface{}{now, now}
+	for _, host := range skipHosts {
+		args = append(args, host)
+	}
+	args = append(args, aging, aging, aging)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(skipHosts)), ",")
+	// Cancelled job isn't limited by its host, so it is never skipped.
+	query := fmt.Sprintf(selectClaimableJobQuery, fmt.Sprintf("AND (host NOT IN (%s) OR cancelled=1)", placeholders))
+	return s.db.QueryRow(s.dialect.rebind(query), args...)
+}
+
+// SelectJob returns job by id or nil if job doesn't exist.
+func (s *storage) SelectJob(jobId int) (*JobModel, error) {
+	job, err := scanJob(s.selectJobStmt.QueryRow(jobId))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// RetryJob returns job leased by the owner to the queue, job is claimable again after availableAt.
+// Returns false if job is cancelled or is not owned by the owner anymore.
+func (s *storage) RetryJob(jobId int, owner string, availableAt int64) (bool, error) {
+	return affected(s.retryJobStmt.Exec(availableAt, jobId, owner))
+}
+
+// DeferJob returns job leased by the owner to the queue without processing (neither claim nor attempt is counted),
+// job is claimable again after availableAt. Returns false if job is cancelled or is not owned by the owner anymore.
+func (s *storage) DeferJob(jobId int, owner string, availableAt int64) (bool, error) {
+	return affected(s.deferJobStmt.Exec(availableAt, jobId, owner))
+}
+
+// SelectDelayedJobs returns jobs waiting for their next attempt ordered by its time.
+func (s *storage) SelectDelayedJobs(now int64) ([]JobModel, error) {
+	rows, err := s.selectDelayedJobsStmt.Query(now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]JobModel, 0)
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *job)
+	}
+	return ret, nil
+}
+
+// ExtendJob prolongs lease of the job.
+// Returns false if job is cancelled or is not owned by the owner anymore.
+func (s *storage) ExtendJob(jobId int, owner string, leaseUntil int64) (bool, error) {
+	return affected(s.extendJobStmt.Exec(leaseUntil, jobId, owner))
+}
+
+// DeleteJob removes finished job. Job which is owned by another worker is left as is.
+func (s *storage) DeleteJob(jobId int, owner string) error {
+	_, err := s.deleteJobStmt.Exec(jobId, owner)
+	return err
+}
+
+// DeleteQueuedJob removes job of the file if it isn't leased by any worker.
+// Returns false if there is no such job.
+func (s *storage) DeleteQueuedJob(fileId int, now int64) (bool, error) {
+	return affected(s.deleteQueuedJobStmt.Exec(fileId, now))
+}
+
+// CancelJob marks job of the file leased by worker as cancelled, so its lease is not extended anymore.
+// Returns false if there is no such job.
+func (s *storage) CancelJob(fileId int, now int64) (bool, error) {
+	return affected(s.cancelJobStmt.Exec(fileId, now))
+}
+
+// SelectJobPosition returns position of the file job in the queue (ordered as by ClaimJob),
+// zero if file isn't waiting in the queue or its job is delayed till the next attempt.
+func (s *storage) SelectJobPosition(fileId int, now, aging int64) (int, error) {
+	var position int
+	err := s.selectJobPositionStmt.QueryRow(aging, aging, aging, now, now, fileId).Scan(&position)
+	return position, err
+}
+
+// CountJobs returns count of waiting jobs by priority, count of delayed jobs and count of leased jobs.
+func (s *storage) CountJobs(now int64) (*JobsCount, error) {
+	rows, err := s.countJobsStmt.Query(now, now, now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var priority, queued, delayed, leased int
+	ret := &JobsCount{Queued: make(map[int]int)}
+	for rows.Next() {
+		if err = rows.Scan(&priority, &queued, &delayed, &leased); err != nil {
+			return nil, err
+		}
+		if queued > 0 {
+			ret.Queued[priority] = queued
+		}
+		ret.Delayed += delayed
+		ret.Leased += leased
+	}
+	return ret, nil
+}
+
+// EnqueueBatch enqueues all files (as EnqueueFile does) and groups them into the batch within one transaction,
+// so either all files are queued or none of them. Returns id of the batch and ids of the files.
+func (s *storage) EnqueueBatch(models []*FileModel, priority int, now int64) (int, []int, error) {
+	tx, err := s.dialect.beginWrite(s.db)
+	if err != nil {
+		return -1, nil, err
+	}
+	batchId, fileIds, err := s.enqueueBatch(tx, models, priority, now)
+	if err != nil {
+		tx.Rollback()
+		return -1, nil, err
+	}
+	return batchId, fileIds, tx.Commit()
+}
+
+func (s *storage) enqueueBatch(tx *sql.Tx, models []*FileModel, priority int, now int64) (int, []int, error) {
+	batchId, err := s.dialect.insert(tx.Stmt(s.insertBatchStmt), now)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	fileIds := make([]int, 0, len(models))
+	insertFileStmt := tx.Stmt(s.insertBatchFileStmt)
+	for i, model := range models {
+		fileId, err := s.enqueueFile(tx, model, priority, now)
+		if err != nil {
+			return -1, nil, err
+		}
+		if _, err = insertFileStmt.Exec(batchId, i, fileId); err != nil {
+			return -1, nil, err
+		}
+		fileIds = append(fileIds, fileId)
+	}
+	return batchId, fileIds, nil
+}
+
+// SelectBatch returns batch with its files or nil if batch doesn't exist.
+func (s *storage) SelectBatch(batchId int) (*BatchModel, error) {
+	batch := &BatchModel{}
+	err := s.selectBatchStmt.QueryRow(batchId).Scan(&batch.Id, &batch.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.selectBatchFilesStmt.Query(batchId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch.Files = make([]BatchFileModel, 0)
+	for rows.Next() {
+		file := BatchFileModel{}
+		if err = rows.Scan(&file.FileId, &file.Url, &file.Hash, &file.HashAlgo, &file.Status); err != nil {
+			return nil, err
+		}
+		batch.Files = append(batch.Files, file)
+	}
+	return batch, nil
+}
+
+// AcquireBlob links file to the existing blob of the digest and returns the blob, nil if there is no such blob.
+// File already linked to the blob isn't counted twice.
+func (s *storage) AcquireBlob(fileId int, digest string) (*BlobModel, error) {
+	tx, err := s.dialect.beginWrite(s.db)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := s.acquireBlob(tx, fileId, digest)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return blob, tx.Commit()
+}
+
+func (s *storage) acquireBlob(tx *sql.Tx, fileId int, digest string) (*BlobModel, error) {
+	var linked string
+	err := tx.Stmt(s.selectFileBlobStmt).QueryRow(fileId).Scan(&linked)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("file %d doesn't exist", fileId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if linked != digest {
+		ok, err := affected(tx.Stmt(s.refBlobStmt).Exec(digest))
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	blob, err := scanBlob(tx.Stmt(s.selectBlobStmt).QueryRow(digest))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if linked != digest {
+		if _, err = tx.Stmt(s.linkFileBlobStmt).Exec(digest, blob.Location, fileId); err != nil {
+			return nil, err
+		}
+	}
+	return blob, nil
+}
+
+// InsertBlob links file to the blob of the model digest, blob is created if it doesn't exist yet.
+// Returns linked blob: it is not the given one if blob of the digest has been created by another file meanwhile.
+func (s *storage) InsertBlob(fileId int, model *BlobModel) (*BlobModel, error) {
+	tx, err := s.dialect.beginWrite(s.db)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := s.insertBlob(tx, fileId, model)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return blob, tx.Commit()
+}
+
+func (s *storage) insertBlob(tx *sql.Tx, fileId int, model *BlobModel) (*BlobModel, error) {
+	blob, err := s.acquireBlob(tx, fileId, model.Digest)
+	if err != nil || blob != nil {
+		return blob, err
+	}
+
+	_, err = tx.Stmt(s.insertBlobStmt).Exec(model.Digest, model.Key, model.Location, model.MediaInfo, model.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Stmt(s.linkFileBlobStmt).Exec(model.Digest, model.Location, fileId); err != nil {
+		return nil, err
+	}
+	ret := *model
+	ret.Refs = 1
+	return &ret, nil
+}
+
+// DeleteFile deletes file with its logs, media streams, callbacks and batch items and releases its blob.
+// Returns false if file doesn't exist or has job (queued or in progress). Returns blob if its last
+// reference is released: blob is deleted too and has to be removed from the blob store.
+func (s *storage) DeleteFile(fileId int) (bool, *BlobModel, error) {
+	tx, err := s.dialect.beginWrite(s.db)
+	if err != nil {
+		return false, nil, err
+	}
+	deleted, blob, err := s.deleteFile(tx, fileId)
+	if err != nil || !deleted {
+		tx.Rollback()
+		return false, nil, err
+	}
+	return true, blob, tx.Commit()
+}
+
+func (s *storage) deleteFile(tx *sql.Tx, fileId int) (bool, *BlobModel, error) {
+	var jobId int
+	err := tx.Stmt(s.selectJobByFileStmt).QueryRow(fileId).Scan(&jobId)
+	if err == nil {
+		return false, nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, nil, err
+	}
+
+	var digest string
+	err = tx.Stmt(s.selectFileBlobStmt).QueryRow(fileId).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	for _, stmt := range s.deleteFileStmts {
+		if _, err = tx.Stmt(stmt).Exec(fileId); err != nil {
+			return false, nil, err
+		}
+	}
+	if digest == "" {
+		return true, nil, nil
+	}
+
+	if _, err = tx.Stmt(s.unrefBlobStmt).Exec(digest); err != nil {
+		return false, nil, err
+	}
+	blob, err := scanBlob(tx.Stmt(s.selectBlobStmt).QueryRow(digest))
+	if err == sql.ErrNoRows {
+		return true, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if blob.Refs > 0 {
+		return true, nil, nil
+	}
+	if _, err = tx.Stmt(s.deleteBlobStmt).Exec(digest); err != nil {
+		return false, nil, err
+	}
+	return true, blob, nil
+}
+
+func scanBlob(row *sql.Row) (*BlobModel, error) {
+	blob := &BlobModel{}
+	err := row.Scan(&blob.Digest, &blob.Key, &blob.Location, &blob.MediaInfo, &blob.Refs, &blob.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+func (s *storage) InsertLog(model *LogModel) (int, error) {
+	_, err := s.insertLogStmt.Exec(model.FileId, model.Status, model.Message)
+	return -1, err
+}
+
+// scanJob scans job selected with the file info (as by selectJobStmt).
+func scanJob(row interface {
+	Scan(dest ...interface{}) error
+}) (*JobModel, error) {
+	job := &JobModel{}
+	err := row.Scan(
+		&job.Id, &job.FileId, &job.Host, &job.Url, &job.Hash, &job.HashAlgo, &job.Priority, &job.Owner,
+		&job.LeaseUntil, &job.AvailableAt, &job.Claims, &job.Attempts, &job.Cancelled, &job.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// affected reports whether executed statement changed any rows.
+func affected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func getStatistic(stmt *sql.Stmt, args ...interface{}) (Statistic, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var id, status int
+	var url, hash, hashAlgo, bitrate, resolution, mediaInfo, location, message string
+
+	files := make(Statistic)
+	for rows.Next() {
+		err = rows.Scan(&id, &url, &hash, &hashAlgo, &bitrate, &resolution, &mediaInfo, &location, &status, &message)
+		if err != nil {
+			return nil, err
+		}
+
+		log := map[string]string{
+			"status":  StatusName(status),
+			"message": message,
+		}
+
+		if file, ok := files[url]; ok {
+			file["log"] = append(file["log"].([]map[string]string), log)
+			continue
+		}
+
+		file := make(map[string]interface{}, 0)
+		file["id"] = id
+		file["hash"] = hash
+		file["hash_algo"] = hashAlgo
+		file["bitrate"] = bitrate
+		file["resolution"] = resolution
+		file["location"] = location
+		if mediaInfo != "" {
+			file["media"] = json.RawMessage(mediaInfo)
+		}
+		file["log"] = []map[string]string{log}
+
+		files[url] = file
+	}
+
+	return files, nil
+}
+
+// selectClaimableJobQuery selects the first claimable job, `%s` is replaced by extra conditions.
+// Queue order: priority with aging (created_at - priority * aging) or strict priority if aging is zero.
+const selectClaimableJobQuery = `
+	SELECT id
+	  FROM jobs
+	 WHERE lease_until <= ?
+	   AND available_at <= ?
+	   %s
+	 ORDER BY CASE WHEN ? > 0 THEN created_at - priority * ? ELSE -priority END,
+	          CASE WHEN ? > 0 THEN 0 ELSE created_at END,
+	          id
+	 LIMIT 1
+`
+
+func prepareStatements(logger *logrus.Logger, db *sql.DB, d *dialect) (Storager, error) {
+	insertFileStmt, err := d.prepareInsert(db, `
+		INSERT INTO files(url, hash, hash_algo, resolution, bitrate, callback_url) VALUES (?,?,?,?,?,?)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertLogStmt, err := d.prepare(db, "INSERT INTO log(file_id, status, message) VALUES (?,?,?)")
+	if err != nil {
+		return nil, err
+	}
+
+	selectFileStmt, err := d.prepare(db, "SELECT id FROM files WHERE url=? AND hash=?")
+	if err != nil {
+		return nil, err
+	}
+
+	selectFileByIdStmt, err := d.prepare(db, `
+		SELECT id, url, hash, hash_algo, bitrate, resolution, media_info, callback_url, location, blob_digest
+		  FROM files
+		 WHERE id=?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectLogsStmt, err := d.prepare(db, "SELECT status, message FROM log WHERE file_id=? ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	checkFileIsCompletedStmt, err := d.prepare(db, fmt.Sprintf(`
+		SELECT DISTINCT f.id
+	      FROM files f
+	      JOIN log l
+	        ON l.file_id = f.id
+	     WHERE l.status IN (%d)
+	       AND f.id = ?
+	`, STATUS_COMPLETED))
+	if err != nil {
+		return nil, err
+	}
+
+	selectFilesStmt, err := d.prepare(db, `
+		SELECT f.id, f.url, f.hash, f.hash_algo, f.bitrate, f.resolution, f.media_info, f.location, l.status, l.message
+		  FROM files f
+		  JOIN log l
+			ON l.file_id = f.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectFilesByUrlStmt, err := d.prepare(db, `
+		SELECT f.id, f.url, f.hash, f.hash_algo, f.bitrate, f.resolution, f.media_info, f.location, l.status, l.message
+		  FROM files f
+		  JOIN log l
+			ON l.file_id = f.id
+		 WHERE f.url = ?
+		   AND f.hash = ?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateFileStmt, err := d.prepare(db, `UPDATE files SET bitrate=?, resolution=?, media_info=?, location=? WHERE id=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateFileCallbackStmt, err := d.prepare(db, `UPDATE files SET callback_url=? WHERE id=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertCallbackStmt, err := d.prepareInsert(db, `
+		INSERT INTO callbacks(file_id, url, payload, status, attempts, next_attempt_at, last_error)
+		VALUES (?,?,?,?,?,?,?)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateCallbackStmt, err := d.prepare(db, `
+		UPDATE callbacks SET status=?, attempts=?, next_attempt_at=?, last_error=?, owner='', lease_until=0 WHERE id=?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectCallbacksStmt, err := d.prepare(db, `
+		SELECT id, file_id, url, payload, status, attempts, next_attempt_at, last_error, owner, lease_until
+		  FROM callbacks
+		 WHERE status = ?
+		   AND next_attempt_at <= ?
+		 ORDER BY next_attempt_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectCallbackStmt, err := d.prepare(db, `
+		SELECT id, file_id, url, payload, status, attempts, next_attempt_at, last_error, owner, lease_until
+		  FROM callbacks
+		 WHERE id = ?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectDueCallbackStmt, err := d.prepare(db, `
+		SELECT id
+		  FROM callbacks
+		 WHERE status = ?
+		   AND next_attempt_at <= ?
+		   AND lease_until <= ?
+		 ORDER BY next_attempt_at, id
+		 LIMIT 1
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	claimCallbackStmt, err := d.prepare(db, `
+		UPDATE callbacks SET owner=?, lease_until=?
+		 WHERE id=? AND status=? AND next_attempt_at <= ? AND lease_until <= ?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertMediaStreamStmt, err := d.prepare(db, `
+		INSERT INTO media_streams(
+			file_id, stream_index, codec_type, codec_name, width, height, bit_rate, duration, language
+		) VALUES (?,?,?,?,?,?,?,?,?)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteMediaStreamsStmt, err := d.prepare(db, `DELETE FROM media_streams WHERE file_id=?`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectMediaStreamsStmt, err := d.prepare(db, `
+		SELECT file_id, stream_index, codec_type, codec_name, width, height, bit_rate, duration, language
+		  FROM media_streams
+		 WHERE file_id = ?
+		 ORDER BY stream_index
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertJobStmt, err := d.prepareInsert(db, "INSERT INTO jobs(file_id, host, priority, created_at) VALUES (?,?,?,?)")
+	if err != nil {
+		return nil, err
+	}
+
+	selectJobStmt, err := d.prepare(db, `
+		SELECT j.id, j.file_id, j.host, f.url, f.hash, f.hash_algo, j.priority, j.owner,
+		       j.lease_until, j.available_at, j.claims, j.attempts, j.cancelled, j.created_at
+		  FROM jobs j
+		  JOIN files f
+		    ON f.id = j.file_id
+		 WHERE j.id = ?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectDelayedJobsStmt, err := d.prepare(db, `
+		SELECT j.id, j.file_id, j.host, f.url, f.hash, f.hash_algo, j.priority, j.owner,
+		       j.lease_until, j.available_at, j.claims, j.attempts, j.cancelled, j.created_at
+		  FROM jobs j
+		  JOIN files f
+		    ON f.id = j.file_id
+		 WHERE j.lease_until <= ?
+		   AND j.available_at > ?
+		 ORDER BY j.available_at, j.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectJobByFileStmt, err := d.prepare(db, "SELECT id FROM jobs WHERE file_id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	raiseJobPriorityStmt, err := d.prepare(db, "UPDATE jobs SET priority=? WHERE id=? AND priority < ?")
+	if err != nil {
+		return nil, err
+	}
+
+	selectClaimableJobStmt, err := d.prepare(db, fmt.Sprintf(selectClaimableJobQuery, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	claimJobStmt, err := d.prepare(db, `
+		UPDATE jobs SET owner=?, lease_until=?, claims=claims+1 WHERE id=? AND lease_until <= ? AND available_at <= ?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	retryJobStmt, err := d.prepare(db, `
+		UPDATE jobs SET owner='', lease_until=0, available_at=?, attempts=attempts+1
+		 WHERE id=? AND owner=? AND cancelled=0
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	extendJobStmt, err := d.prepare(db, "UPDATE jobs SET lease_until=? WHERE id=? AND owner=? AND cancelled=0")
+	if err != nil {
+		return nil, err
+	}
+
+	deleteJobStmt, err := d.prepare(db, "DELETE FROM jobs WHERE id=? AND owner=?")
+	if err != nil {
+		return nil, err
+	}
+
+	deferJobStmt, err := d.prepare(db, `
+		UPDATE jobs SET owner='', lease_until=0, available_at=?, claims=claims-1
+		 WHERE id=? AND owner=? AND cancelled=0
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectJobPositionStmt, err := d.prepare(db, `
+		WITH queued AS (
+			SELECT id, file_id,
+			       CASE WHEN ? > 0 THEN created_at - priority * ? ELSE -priority END AS queue_rank,
+			       CASE WHEN ? > 0 THEN 0 ELSE created_at END AS queue_tie
+			  FROM jobs
+			 WHERE lease_until <= ?
+			   AND available_at <= ?
+		)
+		SELECT COUNT(*)
+		  FROM queued j
+		  JOIN queued t
+		    ON j.queue_rank < t.queue_rank
+		    OR (j.queue_rank = t.queue_rank AND (j.queue_tie < t.queue_tie OR (j.queue_tie = t.queue_tie AND j.id <= t.id)))
+		 WHERE t.file_id = ?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteQueuedJobStmt, err := d.prepare(db, "DELETE FROM jobs WHERE file_id=? AND lease_until <= ?")
+	if err != nil {
+		return nil, err
+	}
+
+	cancelJobStmt, err := d.prepare(db, "UPDATE jobs SET cancelled=1 WHERE file_id=? AND lease_until > ?")
+	if err != nil {
+		return nil, err
+	}
+
+	countJobsStmt, err := d.prepare(db, `
+		SELECT priority,
+		       SUM(CASE WHEN lease_until <= ? THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN lease_until <= ? AND available_at > ? THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN lease_until > ? THEN 1 ELSE 0 END)
+		  FROM jobs
+		 GROUP BY priority
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertBatchStmt, err := d.prepareInsert(db, "INSERT INTO batches(created_at) VALUES (?)")
+	if err != nil {
+		return nil, err
+	}
+
+	insertBatchFileStmt, err := d.prepare(db, "INSERT INTO batch_files(batch_id, item_index, file_id) VALUES (?,?,?)")
+	if err != nil {
+		return nil, err
+	}
+
+	selectBatchStmt, err := d.prepare(db, "SELECT id, created_at FROM batches WHERE id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	selectBatchFilesStmt, err := d.prepare(db, `
+		SELECT f.id, f.url, f.hash, f.hash_algo,
+		       COALESCE((SELECT l.status FROM log l WHERE l.file_id = f.id ORDER BY l.id DESC LIMIT 1), 0)
+		  FROM batch_files b
+		  JOIN files f
+		    ON f.id = b.file_id
+		 WHERE b.batch_id = ?
+		 ORDER BY b.item_index
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectBlobStmt, err := d.prepare(db, `
+		SELECT digest, blob_key, location, media_info, refs, created_at FROM blobs WHERE digest=?
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertBlobStmt, err := d.prepare(db, `
+		INSERT INTO blobs(digest, blob_key, location, media_info, refs, created_at) VALUES (?,?,?,?,1,?)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	refBlobStmt, err := d.prepare(db, "UPDATE blobs SET refs=refs+1 WHERE digest=?")
+	if err != nil {
+		return nil, err
+	}
+
+	unrefBlobStmt, err := d.prepare(db, "UPDATE blobs SET refs=refs-1 WHERE digest=?")
+	if err != nil {
+		return nil, err
+	}
+
+	deleteBlobStmt, err := d.prepare(db, "DELETE FROM blobs WHERE digest=? AND refs <= 0")
+	if err != nil {
+		return nil, err
+	}
+
+	selectFileBlobStmt, err := d.prepare(db, "SELECT blob_digest FROM files WHERE id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	linkFileBlobStmt, err := d.prepare(db, "UPDATE files SET blob_digest=?, location=? WHERE id=?")
+	if err != nil {
+		return nil, err
+	}
+
+	// File is deleted by the last statement, after rows referencing it.
+	deleteFileStmts := make([]*sql.Stmt, 0)
+	for _, query := range []string{
+		"DELETE FROM log WHERE file_id=?",
+		"DELETE FROM media_streams WHERE file_id=?",
+		"DELETE FROM callbacks WHERE file_id=?",
+		"DELETE FROM batch_files WHERE file_id=?",
+		"DELETE FROM files WHERE id=?",
+	} {
+		stmt, err := d.prepare(db, query)
+		if err != nil {
+			return nil, err
+		}
+		deleteFileStmts = append(deleteFileStmts, stmt)
+	}
+
+	return &storage{
+		logger:                   logger,
+		db:                       db,
+		dialect:                  d,
+		insertFileStmt:           insertFileStmt,
+		insertCallbackStmt:       insertCallbackStmt,
+		insertLogStmt:            insertLogStmt,
+		selectFilesStmt:          selectFilesStmt,
+		selectFilesByUrlStmt:     selectFilesByUrlStmt,
+		selectFileStmt:           selectFileStmt,
+		selectFileByIdStmt:       selectFileByIdStmt,
+		selectLogsStmt:           selectLogsStmt,
+		updateFileStmt:           updateFileStmt,
+		updateFileCallbackStmt:   updateFileCallbackStmt,
+		updateCallbackStmt:       updateCallbackStmt,
+		selectCallbacksStmt:      selectCallbacksStmt,
+		selectCallbackStmt:       selectCallbackStmt,
+		selectDueCallbackStmt:    selectDueCallbackStmt,
+		claimCallbackStmt:        claimCallbackStmt,
+		insertMediaStreamStmt:    insertMediaStreamStmt,
+		deleteMediaStreamsStmt:   deleteMediaStreamsStmt,
+		selectMediaStreamsStmt:   selectMediaStreamsStmt,
+		checkFileIsCompletedStmt: checkFileIsCompletedStmt,
+		insertJobStmt:            insertJobStmt,
+		selectJobStmt:            selectJobStmt,
+		selectJobByFileStmt:      selectJobByFileStmt,
+		raiseJobPriorityStmt:     raiseJobPriorityStmt,
+		selectClaimableJobStmt:   selectClaimableJobStmt,
+		claimJobStmt:             claimJobStmt,
+		extendJobStmt:            extendJobStmt,
+		deleteJobStmt:            deleteJobStmt,
+		selectJobPositionStmt:    selectJobPositionStmt,
+		countJobsStmt:            countJobsStmt,
+		deleteQueuedJobStmt:      deleteQueuedJobStmt,
+		cancelJobStmt:            cancelJobStmt,
+		insertBatchStmt:          insertBatchStmt,
+		insertBatchFileStmt:      insertBatchFileStmt,
+		selectBatchStmt:          selectBatchStmt,
+		selectBatchFilesStmt:     selectBatchFilesStmt,
+		retryJobStmt:             retryJobStmt,
+		deferJobStmt:             deferJobStmt,
+		selectDelayedJobsStmt:    selectDelayedJobsStmt,
+		selectBlobStmt:           selectBlobStmt,
+		insertBlobStmt:           insertBlobStmt,
+		refBlobStmt:              refBlobStmt,
+		unrefBlobStmt:            unrefBlobStmt,
+		deleteBlobStmt:           deleteBlobStmt,
+		selectFileBlobStmt:       selectFileBlobStmt,
+		linkFileBlobStmt:         linkFileBlobStmt,
+		deleteFileStmts:          deleteFileStmts,
+	}, nil
+}
@@ -0,0 +1,1086 @@
+// Package storagetest contains conformance tests which every storage.Storager implementation must pass.
+//
+// Usage from the implementation tests:
+//
+//	func TestPostgresStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storager {
+//			return storage.NewPostgresStorage(logrus.New(), dsnOfEmptyDatabase(t))
+//		})
+//	}
+package storagetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dk13danger/media-service/storage"
+)
+
+// Factory must return storage without any data for every call.
+type Factory func(t *testing.T) storage.Storager
+
+// Run runs all conformance tests, each one against new storage.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storager)
+	}{
+		{"Files", testFiles},
+		{"DuplicateFile", testDuplicateFile},
+		{"Logs", testLogs},
+		{"EnqueueFile", testEnqueueFile},
+		{"ConcurrentEnqueue", testConcurrentEnqueue},
+		{"Jobs", testJobs},
+		{"JobPriorities", testJobPriorities},
+		{"JobStrictPriorities", testJobStrictPriorities},
+		{"JobSkipHosts", testJobSkipHosts},
+		{"JobCancellation", testJobCancellation},
+		{"JobRetries", testJobRetries},
+		{"Batches", testBatches},
+		{"Blobs", testBlobs},
+		{"ConcurrentBlobs", testConcurrentBlobs},
+		{"DeleteFile", testDeleteFile},
+		{"Statistic", testStatistic},
+		{"Callbacks", testCallbacks},
+		{"CallbackClaims", testCallbackClaims},
+		{"ConcurrentCallbackClaims", testConcurrentCallbackClaims},
+		{"MediaStreams", testMediaStreams},
+	}
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, newStorage(t))
+		})
+	}
+}
+
+func mustInsertFile(t *testing.T, s storage.Storager, url, hash string) int {
+	id, err := s.InsertFile(&storage.FileModel{
+		Url:      url,
+		Hash:     hash,
+		HashAlgo: "md5",
+	})
+	if err != nil {
+		t.Fatalf("InsertFile(%q, %q): %v", url, hash, err)
+	}
+	return id
+}
+
+func mustInsertLog(t *testing.T, s storage.Storager, fileId, status int) {
+	_, err := s.InsertLog(&storage.LogModel{
+		FileId:  fileId,
+		Status:  status,
+		Message: storage.StatusName(status),
+	})
+	if err != nil {
+		t.Fatalf("InsertLog(%d, %d): %v", fileId, status, err)
+	}
+}
+
+func testFiles(t *testing.T, s storage.Storager) {
+	id := mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+	if id < 0 {
+		t.Fatalf("InsertFile returned invalid id: %d", id)
+	}
+
+	if got, err := s.SelectFile("http://host/a.mp4", "hash-a"); err != nil || got != id {
+		t.Fatalf("SelectFile() = %d, %v; want %d", got, err, id)
+	}
+	if got, err := s.SelectFile("http://host/a.mp4", "other"); err != nil || got != -1 {
+		t.Fatalf("SelectFile() of unknown file = %d, %v; want -1", got, err)
+	}
+
+	if _, err := s.UpdateFile(&storage.FileModel{
+		Id:         id,
+		BitRate:    "1000",
+		Resolution: "1280x720",
+		MediaInfo:  `{"container":"mp4"}`,
+		Location:   "file:///opt/media-service/a.mp4-hash-a",
+	}); err != nil {
+		t.Fatalf("UpdateFile(): %v", err)
+	}
+	if err := s.UpdateFileCallback(id, "http://client/callback"); err != nil {
+		t.Fatalf("UpdateFileCallback(): %v", err)
+	}
+
+	file, err := s.SelectFileById(id)
+	if err != nil || file == nil {
+		t.Fatalf("SelectFileById() = %v, %v", file, err)
+	}
+	want := storage.FileModel{
+		Id:          id,
+		Url:         "http://host/a.mp4",
+		Hash:        "hash-a",
+		HashAlgo:    "md5",
+		BitRate:     "1000",
+		Resolution:  "1280x720",
+		MediaInfo:   `{"container":"mp4"}`,
+		CallbackUrl: "http://client/callback",
+		Location:    "file:///opt/media-service/a.mp4-hash-a",
+	}
+	if *file != want {
+		t.Fatalf("SelectFileById() = %+v; want %+v", *file, want)
+	}
+
+	if file, err := s.SelectFileById(id + 1000); err != nil || file != nil {
+		t.Fatalf("SelectFileById() of unknown file = %v, %v; want nil", file, err)
+	}
+}
+
+func testDuplicateFile(t *testing.T, s storage.Storager) {
+	mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+	if _, err := s.InsertFile(&storage.FileModel{Url: "http://host/a.mp4", Hash: "hash-a"}); err == nil {
+		t.Fatal("InsertFile() of duplicate url and hash must fail")
+	}
+	mustInsertFile(t, s, "http://host/a.mp4", "hash-b")
+}
+
+func testLogs(t *testing.T, s storage.Storager) {
+	id := mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+
+	if completed, err := s.CheckFileIsCompleted(id); err != nil || completed {
+		t.Fatalf("CheckFileIsCompleted() of new file = %v, %v; want false", completed, err)
+	}
+
+	mustInsertLog(t, s, id, storage.STATUS_PENDING)
+	mustInsertLog(t, s, id, storage.STATUS_ERROR)
+	mustInsertLog(t, s, id, storage.STATUS_COMPLETED)
+
+	logs, err := s.SelectLogs(id)
+	if err != nil {
+		t.Fatalf("SelectLogs(): %v", err)
+	}
+	statuses := []int{storage.STATUS_PENDING, storage.STATUS_ERROR, storage.STATUS_COMPLETED}
+	if len(logs) != len(statuses) {
+		t.Fatalf("SelectLogs() returned %d records; want %d", len(logs), len(statuses))
+	}
+	for i, l := range logs {
+		if l.FileId != id || l.Status != statuses[i] || l.Message != storage.StatusName(statuses[i]) {
+			t.Fatalf("SelectLogs()[%d] = %+v; want status %d in insertion order", i, l, statuses[i])
+		}
+	}
+
+	if completed, err := s.CheckFileIsCompleted(id); err != nil || !completed {
+		t.Fatalf("CheckFileIsCompleted() = %v, %v; want true", completed, err)
+	}
+}
+
+func testEnqueueFile(t *testing.T, s storage.Storager) {
+	id, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/a.mp4", Hash: "hash-a", HashAlgo: "md5"}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	if got, err := s.SelectFile("http://host/a.mp4", "hash-a"); err != nil || got != id {
+		t.Fatalf("SelectFile() = %d, %v; want %d", got, err, id)
+	}
+
+	// Existing file is not duplicated, but its callback url is updated.
+	again, err := s.EnqueueFile(&storage.FileModel{
+		Url:         "http://host/a.mp4",
+		Hash:        "hash-a",
+		HashAlgo:    "md5",
+		CallbackUrl: "http://client/callback",
+	}, storage.PRIORITY_NORMAL, 101)
+	if err != nil || again != id {
+		t.Fatalf("EnqueueFile() of existing file = %d, %v; want %d", again, err, id)
+	}
+	if file, err := s.SelectFileById(id); err != nil || file.CallbackUrl != "http://client/callback" {
+		t.Fatalf("SelectFileById() = %+v, %v; want updated callback url", file, err)
+	}
+
+	// File has only one queued job.
+	if job, err := s.ClaimJob("worker-1", 200, 300, 0, nil); err != nil || job == nil {
+		t.Fatalf("ClaimJob() = %v, %v; want job", job, err)
+	}
+	if job, err := s.ClaimJob("worker-1", 200, 300, 0, nil); err != nil || job != nil {
+		t.Fatalf("ClaimJob() = %+v, %v; want nil", job, err)
+	}
+}
+
+// testConcurrentEnqueue checks that concurrent enqueues of the same files neither fail nor duplicate them.
+func testConcurrentEnqueue(t *testing.T, s storage.Storager) {
+	const files, clients = 20, 10
+
+	var wg sync.WaitGroup
+	ids := make([][]int, files)
+	errs := make(chan error, files*clients)
+	for i := range ids {
+		ids[i] = make([]int, clients)
+		for j := range ids[i] {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				url := fmt.Sprintf("http://host/%d.mp4", i)
+				id, err := s.EnqueueFile(&storage.FileModel{Url: url, Hash: "hash", HashAlgo: "md5"}, storage.PRIORITY_NORMAL, 100)
+				if err != nil {
+					errs <- fmt.Errorf("EnqueueFile(%q): %v", url, err)
+				}
+				ids[i][j] = id
+			}(i, j)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	for i := range ids {
+		for j := range ids[i] {
+			if ids[i][j] != ids[i][0] {
+				t.Fatalf("EnqueueFile() of file %d returned ids %v; want the same id", i, ids[i])
+			}
+		}
+	}
+	mustCountJobs(t, s, 100, files, 0)
+}
+
+func testJobs(t *testing.T, s storage.Storager) {
+	a, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/a.mp4", Hash: "hash-a", HashAlgo: "md5"}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	b, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/b.mp4", Hash: "hash-b", HashAlgo: "sha1"}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	for fileId, want := range map[int]int{a: 1, b: 2} {
+		if position, err := s.SelectJobPosition(fileId, 200, 0); err != nil || position != want {
+			t.Fatalf("SelectJobPosition(%d) = %d, %v; want %d", fileId, position, err, want)
+		}
+	}
+
+	mustCountJobs(t, s, 200, 2, 0)
+
+	// Jobs are claimed in the queue order.
+	jobA, err := s.ClaimJob("worker-1", 200, 300, 0, nil)
+	if err != nil || jobA == nil {
+		t.Fatalf("ClaimJob() = %v, %v; want job", jobA, err)
+	}
+	want := storage.JobModel{
+		Id:         jobA.Id,
+		FileId:     a,
+		Host:       "host",
+		Url:        "http://host/a.mp4",
+		Hash:       "hash-a",
+		HashAlgo:   "md5",
+		Priority:   storage.PRIORITY_NORMAL,
+		Owner:      "worker-1",
+		LeaseUntil: 300,
+		Claims:     1,
+		CreatedAt:  100,
+	}
+	if *jobA != want {
+		t.Fatalf("ClaimJob() = %+v; want %+v", *jobA, want)
+	}
+	if position, err := s.SelectJobPosition(a, 200, 0); err != nil || position != 0 {
+		t.Fatalf("SelectJobPosition() of claimed job = %d, %v; want 0", position, err)
+	}
+	if position, err := s.SelectJobPosition(b, 200, 0); err != nil || position != 1 {
+		t.Fatalf("SelectJobPosition() = %d, %v; want 1", position, err)
+	}
+
+	mustCountJobs(t, s, 200, 1, 1)
+
+	jobB, err := s.ClaimJob("worker-2", 200, 300, 0, nil)
+	if err != nil || jobB == nil || jobB.FileId != b || jobB.HashAlgo != "sha1" {
+		t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", jobB, err, b)
+	}
+	if job, err := s.ClaimJob("worker-3", 200, 300, 0, nil); err != nil || job != nil {
+		t.Fatalf("ClaimJob() = %+v, %v; want nil while jobs are leased", job, err)
+	}
+
+	// Lease is extended only by its owner.
+	if ok, err := s.ExtendJob(jobA.Id, "worker-1", 500); err != nil || !ok {
+		t.Fatalf("ExtendJob() by owner = %v, %v; want true", ok, err)
+	}
+	if ok, err := s.ExtendJob(jobA.Id, "worker-2", 600); err != nil || ok {
+		t.Fatalf("ExtendJob() by another worker = %v, %v; want false", ok, err)
+	}
+
+	// Job of the died worker is claimable again after its lease expiration.
+	mustCountJobs(t, s, 400, 1, 1)
+	job, err := s.ClaimJob("worker-3", 400, 700, 0, nil)
+	if err != nil || job == nil || job.Id != jobB.Id || job.Claims != 2 {
+		t.Fatalf("ClaimJob() after lease expiration = %+v, %v; want job %d claimed twice", job, err, jobB.Id)
+	}
+	if ok, err := s.ExtendJob(jobB.Id, "worker-2", 800); err != nil || ok {
+		t.Fatalf("ExtendJob() by previous owner = %v, %v; want false", ok, err)
+	}
+
+	// Job is deleted only by its owner.
+	if err := s.DeleteJob(jobB.Id, "worker-2"); err != nil {
+		t.Fatalf("DeleteJob(): %v", err)
+	}
+	if ok, err := s.ExtendJob(jobB.Id, "worker-3", 700); err != nil || !ok {
+		t.Fatalf("ExtendJob() = %v, %v; want job %d not deleted by previous owner", ok, err, jobB.Id)
+	}
+	for id, owner := range map[int]string{jobA.Id: "worker-1", jobB.Id: "worker-3"} {
+		if err := s.DeleteJob(id, owner); err != nil {
+			t.Fatalf("DeleteJob(): %v", err)
+		}
+	}
+	if job, err := s.ClaimJob("worker-5", 1000, 1100, 0, nil); err != nil || job != nil {
+		t.Fatalf("ClaimJob() = %+v, %v; want nil after jobs deletion", job, err)
+	}
+
+	// File can be queued again when its job is finished.
+	_, err = s.EnqueueFile(&storage.FileModel{Url: "http://host/a.mp4", Hash: "hash-a"}, storage.PRIORITY_NORMAL, 1000)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	if job, err := s.ClaimJob("worker-5", 1000, 1100, 0, nil); err != nil || job == nil || job.FileId != a {
+		t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", job, err, a)
+	}
+}
+
+// testJobPriorities checks that higher priority jobs are claimed first,
+// but waiting for aging seconds raises job by one priority level.
+func testJobPriorities(t *testing.T, s storage.Storager) {
+	const aging = 100
+	enqueue := func(url string, priority int, now int64) int {
+		id, err := s.EnqueueFile(&storage.FileModel{Url: url, Hash: "hash", HashAlgo: "md5"}, priority, now)
+		if err != nil {
+			t.Fatalf("EnqueueFile(%q): %v", url, err)
+		}
+		return id
+	}
+	oldLow := enqueue("http://host/old-low.mp4", storage.PRIORITY_LOW, 1000)
+	low := enqueue("http://host/low.mp4", storage.PRIORITY_LOW, 1150)
+	normal := enqueue("http://host/normal.mp4", storage.PRIORITY_NORMAL, 1150)
+	high := enqueue("http://host/high.mp4", storage.PRIORITY_HIGH, 1200)
+	// Priority of the queued job is raised by the request with higher priority, but never lowered.
+	raised := enqueue("http://host/raised.mp4", storage.PRIORITY_LOW, 1160)
+	enqueue("http://host/raised.mp4", storage.PRIORITY_HIGH, 1170)
+	enqueue("http://host/raised.mp4", storage.PRIORITY_LOW, 1180)
+
+	count, err := s.CountJobs(1200)
+	if err != nil {
+		t.Fatalf("CountJobs(): %v", err)
+	}
+	wantCount := map[int]int{storage.PRIORITY_LOW: 2, storage.PRIORITY_NORMAL: 1, storage.PRIORITY_HIGH: 2}
+	if len(count.Queued) != len(wantCount) || count.Leased != 0 {
+		t.Fatalf("CountJobs() = %+v; want queued %v", count, wantCount)
+	}
+	for priority, n := range wantCount {
+		if count.Queued[priority] != n {
+			t.Fatalf("CountJobs() = %+v; want queued %v", count, wantCount)
+		}
+	}
+
+	// Ranks (created_at - priority * aging): raised 860, old-low 900, high 900 (ties are broken by job id),
+	// normal 950, low 1050.
+	order := []int{raised, oldLow, high, normal, low}
+	for i, fileId := range order {
+		if position, err := s.SelectJobPosition(fileId, 1200, aging); err != nil || position != i+1 {
+			t.Fatalf("SelectJobPosition(%d) = %d, %v; want %d", fileId, position, err, i+1)
+		}
+	}
+	for _, fileId := range order {
+		job, err := s.ClaimJob("worker", 1200, 1300, aging, nil)
+		if err != nil || job == nil || job.FileId != fileId {
+			t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", job, err, fileId)
+		}
+	}
+}
+
+// testJobStrictPriorities checks that jobs are ordered by priority and then by creation time if aging is zero.
+func testJobStrictPriorities(t *testing.T, s storage.Storager) {
+	enqueue := func(url string, priority int, now int64) int {
+		id, err := s.EnqueueFile(&storage.FileModel{Url: url, Hash: "hash", HashAlgo: "md5"}, priority, now)
+		if err != nil {
+			t.Fatalf("EnqueueFile(%q): %v", url, err)
+		}
+		return id
+	}
+	oldLow := enqueue("http://host/old-low.mp4", storage.PRIORITY_LOW, 1000)
+	high := enqueue("http://host/high.mp4", storage.PRIORITY_HIGH, 1200)
+	normal := enqueue("http://host/normal.mp4", storage.PRIORITY_NORMAL, 1150)
+	oldHigh := enqueue("http://host/old-high.mp4", storage.PRIORITY_HIGH, 1100)
+	low := enqueue("http://host/low.mp4", storage.PRIORITY_LOW, 1000)
+
+	order := []int{oldHigh, high, normal, oldLow, low}
+	for i, fileId := range order {
+		if position, err := s.SelectJobPosition(fileId, 1200, 0); err != nil || position != i+1 {
+			t.Fatalf("SelectJobPosition(%d) = %d, %v; want %d", fileId, position, err, i+1)
+		}
+	}
+	for _, fileId := range order {
+		job, err := s.ClaimJob("worker", 1200, 1300, 0, nil)
+		if err != nil || job == nil || job.FileId != fileId {
+			t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", job, err, fileId)
+		}
+	}
+}
+
+// testJobSkipHosts checks that jobs of skipped hosts are left in the queue.
+func testJobSkipHosts(t *testing.T, s storage.Storager) {
+	enqueue := func(url string, priority int) int {
+		id, err := s.EnqueueFile(&storage.FileModel{Url: url, Hash: "hash", HashAlgo: "md5"}, priority, 100)
+		if err != nil {
+			t.Fatalf("EnqueueFile(%q): %v", url, err)
+		}
+		return id
+	}
+	a := enqueue("http://Host-A:8080/1.mp4", storage.PRIORITY_HIGH)
+	b := enqueue("https://host-b/1.mp4", storage.PRIORITY_NORMAL)
+	c := enqueue("http://host-c/1.mp4", storage.PRIORITY_LOW)
+
+	job, err := s.ClaimJob("worker", 200, 300, 0, []string{"host-a", "host-b"})
+	if err != nil || job == nil || job.FileId != c || job.Host != "host-c" {
+		t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", job, err, c)
+	}
+	if job, err := s.ClaimJob("worker", 200, 300, 0, []string{"host-a", "host-b"}); err != nil || job != nil {
+		t.Fatalf("ClaimJob() = %+v, %v; want nil when all hosts are skipped", job, err)
+	}
+	job, err = s.ClaimJob("worker", 200, 300, 0, []string{"host-b"})
+	if err != nil || job == nil || job.FileId != a || job.Host != "host-a" {
+		t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", job, err, a)
+	}
+	job, err = s.ClaimJob("worker", 200, 300, 0, []string{})
+	if err != nil || job == nil || job.FileId != b {
+		t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", job, err, b)
+	}
+}
+
+func testJobCancellation(t *testing.T, s storage.Storager) {
+	running, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/a.mp4", Hash: "hash"}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	queued, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/b.mp4", Hash: "hash"}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	job, err := s.ClaimJob("worker", 200, 300, 0, nil)
+	if err != nil || job == nil || job.FileId != running {
+		t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", job, err, running)
+	}
+
+	// Queued job is deleted, leased one is only marked as cancelled.
+	if ok, err := s.DeleteQueuedJob(running, 200); err != nil || ok {
+		t.Fatalf("DeleteQueuedJob() of leased job = %v, %v; want false", ok, err)
+	}
+	if ok, err := s.DeleteQueuedJob(queued, 200); err != nil || !ok {
+		t.Fatalf("DeleteQueuedJob() = %v, %v; want true", ok, err)
+	}
+	if job, err := s.ClaimJob("worker", 200, 300, 0, nil); err != nil || job != nil {
+		t.Fatalf("ClaimJob() = %+v, %v; want nil after deletion", job, err)
+	}
+	if ok, err := s.CancelJob(queued, 200); err != nil || ok {
+		t.Fatalf("CancelJob() of deleted job = %v, %v; want false", ok, err)
+	}
+	if ok, err := s.CancelJob(running, 200); err != nil || !ok {
+		t.Fatalf("CancelJob() = %v, %v; want true", ok, err)
+	}
+
+	cancelled, err := s.SelectJob(job.Id)
+	if err != nil || cancelled == nil || !cancelled.Cancelled || cancelled.Owner != "worker" {
+		t.Fatalf("SelectJob() = %+v, %v; want cancelled job", cancelled, err)
+	}
+	if ok, err := s.ExtendJob(job.Id, "worker", 400); err != nil || ok {
+		t.Fatalf("ExtendJob() of cancelled job = %v, %v; want false", ok, err)
+	}
+	if err := s.DeleteJob(job.Id, "worker"); err != nil {
+		t.Fatalf("DeleteJob(): %v", err)
+	}
+	if job, err := s.SelectJob(job.Id); err != nil || job != nil {
+		t.Fatalf("SelectJob() of deleted job = %+v, %v; want nil", job, err)
+	}
+}
+
+// testJobRetries covers retried and deferred jobs.
+func testJobRetries(t *testing.T, s storage.Storager) {
+	fileA, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/a.mp4", Hash: "hash-a", HashAlgo: "md5"}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	job, err := s.ClaimJob("worker-1", 100, 200, 0, nil)
+	if err != nil || job == nil || job.Attempts != 0 || job.AvailableAt != 0 {
+		t.Fatalf("ClaimJob() = %+v, %v; want job without attempts", job, err)
+	}
+
+	if ok, err := s.RetryJob(job.Id, "worker-2", 300); err != nil || ok {
+		t.Fatalf("RetryJob() by another owner = %v, %v; want false", ok, err)
+	}
+	if ok, err := s.RetryJob(job.Id, "worker-1", 300); err != nil || !ok {
+		t.Fatalf("RetryJob() = %v, %v; want true", ok, err)
+	}
+
+	// Delayed job is waiting in the queue, but it isn't claimable till its next attempt.
+	count, err := s.CountJobs(150)
+	if err != nil || count.Queued[storage.PRIORITY_NORMAL] != 1 || count.Delayed != 1 || count.Leased != 0 {
+		t.Fatalf("CountJobs() = %+v, %v; want 1 queued and delayed job", count, err)
+	}
+	if got, err := s.ClaimJob("worker-2", 150, 250, 0, nil); err != nil || got != nil {
+		t.Fatalf("ClaimJob() of delayed job = %+v, %v; want nil", got, err)
+	}
+	if position, err := s.SelectJobPosition(fileA, 150, 0); err != nil || position != 0 {
+		t.Fatalf("SelectJobPosition() of delayed job = %d, %v; want 0", position, err)
+	}
+	delayed, err := s.SelectDelayedJobs(150)
+	if err != nil || len(delayed) != 1 {
+		t.Fatalf("SelectDelayedJobs() = %+v, %v; want 1 job", delayed, err)
+	}
+	if d := delayed[0]; d.Id != job.Id || d.Url != "http://host/a.mp4" || d.AvailableAt != 300 || d.Attempts != 1 || d.Owner != "" {
+		t.Fatalf("SelectDelayedJobs() = %+v; want job %d available at 300 after 1 attempt", d, job.Id)
+	}
+
+	job, err = s.ClaimJob("worker-2", 300, 400, 0, nil)
+	if err != nil || job == nil || job.Attempts != 1 || job.Claims != 2 {
+		t.Fatalf("ClaimJob() after delay = %+v, %v; want job with 1 attempt and 2 claims", job, err)
+	}
+	if delayed, err = s.SelectDelayedJobs(300); err != nil || len(delayed) != 0 {
+		t.Fatalf("SelectDelayedJobs() = %+v, %v; want none", delayed, err)
+	}
+
+	// Deferred job counts neither claim nor attempt.
+	if ok, err := s.DeferJob(job.Id, "worker-1", 350); err != nil || ok {
+		t.Fatalf("DeferJob() by another owner = %v, %v; want false", ok, err)
+	}
+	if ok, err := s.DeferJob(job.Id, "worker-2", 350); err != nil || !ok {
+		t.Fatalf("DeferJob() = %v, %v; want true", ok, err)
+	}
+	if got, err := s.ClaimJob("worker-2", 300, 400, 0, nil); err != nil || got != nil {
+		t.Fatalf("ClaimJob() of deferred job = %+v, %v; want nil", got, err)
+	}
+	job, err = s.ClaimJob("worker-2", 350, 450, 0, nil)
+	if err != nil || job == nil || job.Attempts != 1 || job.Claims != 2 {
+		t.Fatalf("ClaimJob() after defer = %+v, %v; want job with 1 attempt and 2 claims", job, err)
+	}
+
+	// Cancelled job isn't returned to the queue.
+	if ok, err := s.CancelJob(fileA, 350); err != nil || !ok {
+		t.Fatalf("CancelJob() = %v, %v; want true", ok, err)
+	}
+	if ok, err := s.RetryJob(job.Id, "worker-2", 500); err != nil || ok {
+		t.Fatalf("RetryJob() of cancelled job = %v, %v; want false", ok, err)
+	}
+	if ok, err := s.DeferJob(job.Id, "worker-2", 500); err != nil || ok {
+		t.Fatalf("DeferJob() of cancelled job = %v, %v; want false", ok, err)
+	}
+
+	// Delayed job can be removed from the queue.
+	fileB, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/b.mp4", Hash: "hash-b", HashAlgo: "md5"}, storage.PRIORITY_NORMAL, 350)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	jobB, err := s.ClaimJob("worker-1", 350, 400, 0, nil)
+	if err != nil || jobB == nil || jobB.FileId != fileB {
+		t.Fatalf("ClaimJob() = %+v, %v; want job of file %d", jobB, err, fileB)
+	}
+	if ok, err := s.RetryJob(jobB.Id, "worker-1", 1000); err != nil || !ok {
+		t.Fatalf("RetryJob() = %v, %v; want true", ok, err)
+	}
+	if ok, err := s.DeleteQueuedJob(fileB, 350); err != nil || !ok {
+		t.Fatalf("DeleteQueuedJob() of delayed job = %v, %v; want true", ok, err)
+	}
+}
+
+func testBatches(t *testing.T, s storage.Storager) {
+	existing := mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+	mustInsertLog(t, s, existing, storage.STATUS_COMPLETED)
+
+	batchId, fileIds, err := s.EnqueueBatch([]*storage.FileModel{
+		{Url: "http://host/b.mp4", Hash: "hash-b", HashAlgo: "md5"},
+		{Url: "http://host/a.mp4", Hash: "hash-a", HashAlgo: "md5"},
+		{Url: "http://host/b.mp4", Hash: "hash-b", HashAlgo: "md5"},
+	}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueBatch(): %v", err)
+	}
+	if len(fileIds) != 3 || fileIds[1] != existing || fileIds[0] != fileIds[2] || fileIds[0] == existing {
+		t.Fatalf("EnqueueBatch() file ids = %v; want [new, %d, new]", fileIds, existing)
+	}
+	// Duplicated file has only one job.
+	mustCountJobs(t, s, 100, 2, 0)
+
+	mustInsertLog(t, s, fileIds[0], storage.STATUS_PENDING)
+
+	batch, err := s.SelectBatch(batchId)
+	if err != nil || batch == nil {
+		t.Fatalf("SelectBatch() = %v, %v; want batch", batch, err)
+	}
+	if batch.Id != batchId || batch.CreatedAt != 100 || len(batch.Files) != 3 {
+		t.Fatalf("SelectBatch() = %+v; want batch %d with 3 files", batch, batchId)
+	}
+	for i, status := range []int{storage.STATUS_PENDING, storage.STATUS_COMPLETED, storage.STATUS_PENDING} {
+		file := batch.Files[i]
+		if file.FileId != fileIds[i] || file.Status != status {
+			t.Errorf("SelectBatch() file #%d = %+v; want id %d with status %d", i, file, fileIds[i], status)
+		}
+	}
+	if batch.Files[0].Url != "http://host/b.mp4" || batch.Files[0].Hash != "hash-b" || batch.Files[0].HashAlgo != "md5" {
+		t.Errorf("SelectBatch() file #0 = %+v; want b.mp4", batch.Files[0])
+	}
+
+	// File without log records has zero status.
+	otherId, otherFiles, err := s.EnqueueBatch([]*storage.FileModel{
+		{Url: "http://host/c.mp4", Hash: "hash-c", HashAlgo: "md5"},
+	}, storage.PRIORITY_HIGH, 101)
+	if err != nil || otherId == batchId {
+		t.Fatalf("EnqueueBatch() = %d, %v; want new batch", otherId, err)
+	}
+	if batch, err = s.SelectBatch(otherId); err != nil || len(batch.Files) != 1 || batch.Files[0].Status != 0 {
+		t.Fatalf("SelectBatch() = %+v, %v; want one queued file %d", batch, err, otherFiles[0])
+	}
+
+	if batch, err = s.SelectBatch(otherId + 100); err != nil || batch != nil {
+		t.Fatalf("SelectBatch() of unknown batch = %+v, %v; want nil", batch, err)
+	}
+}
+
+func mustCountJobs(t *testing.T, s storage.Storager, now int64, queued, leased int) {
+	count, err := s.CountJobs(now)
+	if err != nil || count.Queued[storage.PRIORITY_NORMAL] != queued || count.Leased != leased {
+		t.Fatalf("CountJobs(%d) = %+v, %v; want %d queued, %d leased", now, count, err, queued, leased)
+	}
+}
+
+func testBlobs(t *testing.T, s storage.Storager) {
+	a := mustInsertFile(t, s, "http://host/a.mp4", "hash")
+	b := mustInsertFile(t, s, "http://mirror/b.mp4", "hash")
+
+	if blob, err := s.AcquireBlob(a, "md5:hash"); err != nil || blob != nil {
+		t.Fatalf("AcquireBlob() of unknown digest = %+v, %v; want nil", blob, err)
+	}
+	model := &storage.BlobModel{
+		Digest:    "md5:hash",
+		Key:       "md5/hash-a",
+		Location:  "s3://media/md5/hash-a",
+		MediaInfo: `{"container":"mp4"}`,
+		CreatedAt: 100,
+	}
+	blob, err := s.InsertBlob(a, model)
+	want := *model
+	want.Refs = 1
+	if err != nil || blob == nil || *blob != want {
+		t.Fatalf("InsertBlob() = %+v, %v; want %+v", blob, err, want)
+	}
+
+	// Blob of the same digest stored by another file meanwhile loses, the first one is linked.
+	other := *model
+	other.Key = "md5/hash-b"
+	other.Location = "s3://media/md5/hash-b"
+	blob, err = s.InsertBlob(b, &other)
+	if err != nil || blob == nil || blob.Key != "md5/hash-a" || blob.Refs != 2 {
+		t.Fatalf("InsertBlob() of existing digest = %+v, %v; want the first blob with 2 refs", blob, err)
+	}
+	// Linked file isn't counted twice.
+	blob, err = s.AcquireBlob(b, "md5:hash")
+	if err != nil || blob == nil || blob.Refs != 2 {
+		t.Fatalf("AcquireBlob() of linked file = %+v, %v; want blob with 2 refs", blob, err)
+	}
+
+	file, err := s.SelectFileById(b)
+	if err != nil || file.BlobDigest != "md5:hash" || file.Location != "s3://media/md5/hash-a" {
+		t.Fatalf("SelectFileById() = %+v, %v; want file linked to the blob", file, err)
+	}
+
+	c := mustInsertFile(t, s, "http://other/c.mp4", "hash")
+	blob, err = s.AcquireBlob(c, "md5:hash")
+	if err != nil || blob == nil || blob.Refs != 3 || blob.Location != "s3://media/md5/hash-a" {
+		t.Fatalf("AcquireBlob() = %+v, %v; want blob with 3 refs", blob, err)
+	}
+	if _, err := s.AcquireBlob(c+1000, "md5:hash"); err == nil {
+		t.Fatal("AcquireBlob() of unknown file must fail")
+	}
+}
+
+func testDeleteFile(t *testing.T, s storage.Storager) {
+	a := mustInsertFile(t, s, "http://host/a.mp4", "hash")
+	b := mustInsertFile(t, s, "http://mirror/b.mp4", "hash")
+	mustInsertLog(t, s, a, storage.STATUS_COMPLETED)
+	if err := s.InsertMediaStreams(a, []storage.MediaStreamModel{{FileId: a, CodecType: "video"}}); err != nil {
+		t.Fatalf("InsertMediaStreams(): %v", err)
+	}
+	model := &storage.BlobModel{Digest: "md5:hash", Key: "md5/hash-a", Location: "file:///a", CreatedAt: 100}
+	for _, id := range []int{a, b} {
+		if _, err := s.InsertBlob(id, model); err != nil {
+			t.Fatalf("InsertBlob(): %v", err)
+		}
+	}
+
+	queued, err := s.EnqueueFile(&storage.FileModel{Url: "http://host/c.mp4", Hash: "hash-c", HashAlgo: "md5"}, storage.PRIORITY_NORMAL, 100)
+	if err != nil {
+		t.Fatalf("EnqueueFile(): %v", err)
+	}
+	if deleted, _, err := s.DeleteFile(queued); err != nil || deleted {
+		t.Fatalf("DeleteFile() of queued file = %v, %v; want false", deleted, err)
+	}
+	if deleted, _, err := s.DeleteFile(b + 1000); err != nil || deleted {
+		t.Fatalf("DeleteFile() of unknown file = %v, %v; want false", deleted, err)
+	}
+
+	deleted, blob, err := s.DeleteFile(a)
+	if err != nil || !deleted || blob != nil {
+		t.Fatalf("DeleteFile() = %v, %+v, %v; want deleted file and blob kept", deleted, blob, err)
+	}
+	if file, err := s.SelectFileById(a); err != nil || file != nil {
+		t.Fatalf("SelectFileById() of deleted file = %+v, %v; want nil", file, err)
+	}
+	if logs, err := s.SelectLogs(a); err != nil || len(logs) != 0 {
+		t.Fatalf("SelectLogs() of deleted file = %+v, %v; want none", logs, err)
+	}
+	if streams, err := s.SelectMediaStreams(a); err != nil || len(streams) != 0 {
+		t.Fatalf("SelectMediaStreams() of deleted file = %+v, %v; want none", streams, err)
+	}
+
+	// The last reference releases the blob.
+	deleted, blob, err = s.DeleteFile(b)
+	if err != nil || !deleted || blob == nil || blob.Key != "md5/hash-a" {
+		t.Fatalf("DeleteFile() = %v, %+v, %v; want released blob", deleted, blob, err)
+	}
+	c := mustInsertFile(t, s, "http://other/c.mp4", "hash")
+	if blob, err := s.AcquireBlob(c, "md5:hash"); err != nil || blob != nil {
+		t.Fatalf("AcquireBlob() of released blob = %+v, %v; want nil", blob, err)
+	}
+}
+
+// testConcurrentBlobs checks that files of the same content processed concurrently are linked to one blob
+// and the blob is released once when they are deleted concurrently.
+func testConcurrentBlobs(t *testing.T, s storage.Storager) {
+	const files = 40
+
+	ids := make([]int, files)
+	for i := range ids {
+		ids[i] = mustInsertFile(t, s, fmt.Sprintf("http://host/%d.mp4", i), "hash")
+	}
+
+	var wg sync.WaitGroup
+	keys := make([]string, files)
+	errs := make(chan error, files)
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i, id int) {
+			defer wg.Done()
+			blob, err := s.AcquireBlob(id, "md5:hash")
+			if err == nil && blob == nil {
+				key := fmt.Sprintf("md5/hash-%d", id)
+				blob, err = s.InsertBlob(id, &storage.BlobModel{Digest: "md5:hash", Key: key, Location: "s3://media/" + key, CreatedAt: 100})
+			}
+			if err != nil {
+				errs <- fmt.Errorf("file %d: %v", id, err)
+				return
+			}
+			keys[i] = blob.Key
+		}(i, id)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+	for i := range keys {
+		if keys[i] != keys[0] {
+			t.Fatalf("files are linked to blobs %v; want one blob", keys)
+		}
+	}
+	if blob, err := s.AcquireBlob(ids[0], "md5:hash"); err != nil || blob == nil || blob.Refs != files {
+		t.Fatalf("AcquireBlob() = %+v, %v; want blob with %d refs", blob, err, files)
+	}
+
+	released := make(chan *storage.BlobModel, files)
+	errs = make(chan error, files)
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			deleted, blob, err := s.DeleteFile(id)
+			if err != nil || !deleted {
+				errs <- fmt.Errorf("DeleteFile(%d) = %v, %v; want deleted file", id, deleted, err)
+				return
+			}
+			if blob != nil {
+				released <- blob
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	close(released)
+	for err := range errs {
+		t.Error(err)
+	}
+	if count := len(released); count != 1 {
+		t.Fatalf("DeleteFile() released blob %d times; want once", count)
+	}
+}
+
+func testStatistic(t *testing.T, s storage.Storager) {
+	a := mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+	mustInsertLog(t, s, a, storage.STATUS_PENDING)
+	mustInsertLog(t, s, a, storage.STATUS_COMPLETED)
+	b := mustInsertFile(t, s, "http://host/b.mp4", "hash-b")
+	mustInsertLog(t, s, b, storage.STATUS_PENDING)
+	// Files without logs are not included into statistic.
+	mustInsertFile(t, s, "http://host/c.mp4", "hash-c")
+
+	stat, err := s.GetStatistic()
+	if err != nil {
+		t.Fatalf("GetStatistic(): %v", err)
+	}
+	if len(stat) != 2 {
+		t.Fatalf("GetStatistic() returned %d files; want 2", len(stat))
+	}
+	file := stat["http://host/a.mp4"]
+	if file == nil || file["id"] != a || file["hash"] != "hash-a" || file["hash_algo"] != "md5" {
+		t.Fatalf("GetStatistic() returned invalid file: %v", file)
+	}
+	if logs := file["log"].([]map[string]string); len(logs) != 2 {
+		t.Fatalf("GetStatistic() returned %d log records; want 2", len(logs))
+	}
+
+	stat, err = s.GetStatisticByUrl("http://host/b.mp4", "hash-b")
+	if err != nil {
+		t.Fatalf("GetStatisticByUrl(): %v", err)
+	}
+	if len(stat) != 1 || stat["http://host/b.mp4"]["id"] != b {
+		t.Fatalf("GetStatisticByUrl() = %v; want only file %d", stat, b)
+	}
+}
+
+func testCallbacks(t *testing.T, s storage.Storager) {
+	fileId := mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+	now := time.Now().Unix()
+
+	ready := &storage.CallbackModel{
+		FileId:        fileId,
+		Url:           "http://client/ready",
+		Payload:       `{"task_id":1}`,
+		Status:        storage.CALLBACK_PENDING,
+		NextAttemptAt: now - 10,
+	}
+	delayed := &storage.CallbackModel{
+		FileId:        fileId,
+		Url:           "http://client/delayed",
+		Payload:       `{"task_id":1}`,
+		Status:        storage.CALLBACK_PENDING,
+		NextAttemptAt: now + 100,
+	}
+	for _, c := range []*storage.CallbackModel{ready, delayed} {
+		id, err := s.InsertCallback(c)
+		if err != nil {
+			t.Fatalf("InsertCallback(): %v", err)
+		}
+		c.Id = id
+	}
+
+	callbacks, err := s.SelectPendingCallbacks(now)
+	if err != nil {
+		t.Fatalf("SelectPendingCallbacks(): %v", err)
+	}
+	if len(callbacks) != 1 || callbacks[0] != *ready {
+		t.Fatalf("SelectPendingCallbacks() = %+v; want only %+v", callbacks, *ready)
+	}
+
+	ready.Status = storage.CALLBACK_DELIVERED
+	ready.Attempts = 1
+	if _, err := s.UpdateCallback(ready); err != nil {
+		t.Fatalf("UpdateCallback(): %v", err)
+	}
+	callbacks, err = s.SelectPendingCallbacks(now + 1000)
+	if err != nil {
+		t.Fatalf("SelectPendingCallbacks(): %v", err)
+	}
+	if len(callbacks) != 1 || callbacks[0].Id != delayed.Id {
+		t.Fatalf("SelectPendingCallbacks() = %+v; want only callback %d", callbacks, delayed.Id)
+	}
+}
+
+func testCallbackClaims(t *testing.T, s storage.Storager) {
+	fileId := mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+	ids := make([]int, 0)
+	for i, nextAttemptAt := range []int64{90, 80, 200} {
+		id, err := s.InsertCallback(&storage.CallbackModel{
+			FileId:        fileId,
+			Url:           fmt.Sprintf("http://client/%d", i),
+			Payload:       `{"task_id":1}`,
+			Status:        storage.CALLBACK_PENDING,
+			NextAttemptAt: nextAttemptAt,
+		})
+		if err != nil {
+			t.Fatalf("InsertCallback(): %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Due callbacks are claimed in order of their next attempt, each one by a single owner.
+	first, err := s.ClaimCallback("a", 100, 150)
+	if err != nil || first == nil || first.Id != ids[1] || first.Owner != "a" || first.LeaseUntil != 150 {
+		t.Fatalf("ClaimCallback() = %+v, %v; want callback %d leased by a", first, err, ids[1])
+	}
+	second, err := s.ClaimCallback("b", 100, 150)
+	if err != nil || second == nil || second.Id != ids[0] || second.Url != "http://client/0" {
+		t.Fatalf("ClaimCallback() = %+v, %v; want callback %d", second, err, ids[0])
+	}
+	if c, err := s.ClaimCallback("b", 100, 150); err != nil || c != nil {
+		t.Fatalf("ClaimCallback() = %+v, %v; want nil while callbacks are leased", c, err)
+	}
+
+	// Update releases the lease: failed delivery is claimed again at its next attempt.
+	first.Attempts = 1
+	first.NextAttemptAt = 120
+	first.LastError = "unexpected response status: 500"
+	if _, err := s.UpdateCallback(first); err != nil {
+		t.Fatalf("UpdateCallback(): %v", err)
+	}
+	if c, err := s.ClaimCallback("b", 110, 160); err != nil || c != nil {
+		t.Fatalf("ClaimCallback() = %+v, %v; want nil before next attempt", c, err)
+	}
+	c, err := s.ClaimCallback("b", 120, 170)
+	if err != nil || c == nil || c.Id != ids[1] || c.Owner != "b" || c.Attempts != 1 || c.LastError != first.LastError {
+		t.Fatalf("ClaimCallback() = %+v, %v; want retried callback %d leased by b", c, err, ids[1])
+	}
+
+	// Delivered callback is not claimed anymore.
+	second.Status = storage.CALLBACK_DELIVERED
+	second.Attempts = 1
+	if _, err := s.UpdateCallback(second); err != nil {
+		t.Fatalf("UpdateCallback(): %v", err)
+	}
+	// Expired lease of the lost delivery makes it claimable by another owner.
+	c, err = s.ClaimCallback("a", 200, 250)
+	if err != nil || c == nil || c.Id != ids[1] || c.Owner != "a" {
+		t.Fatalf("ClaimCallback() = %+v, %v; want callback %d with expired lease", c, err, ids[1])
+	}
+	c, err = s.ClaimCallback("a", 200, 250)
+	if err != nil || c == nil || c.Id != ids[2] {
+		t.Fatalf("ClaimCallback() = %+v, %v; want callback %d", c, err, ids[2])
+	}
+	if c, err := s.ClaimCallback("a", 200, 250); err != nil || c != nil {
+		t.Fatalf("ClaimCallback() = %+v, %v; want nil", c, err)
+	}
+}
+
+func testConcurrentCallbackClaims(t *testing.T, s storage.Storager) {
+	const callbacks, notifiers = 20, 5
+
+	fileId := mustInsertFile(t, s, "http://host/a.mp4", "hash-a")
+	for i := 0; i < callbacks; i++ {
+		_, err := s.InsertCallback(&storage.CallbackModel{
+			FileId:        fileId,
+			Url:           fmt.Sprintf("http://client/%d", i),
+			Status:        storage.CALLBACK_PENDING,
+			NextAttemptAt: 100,
+		})
+		if err != nil {
+			t.Fatalf("InsertCallback(): %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := make(map[int]string)
+	errs := make(chan error, callbacks*notifiers)
+	for i := 0; i < notifiers; i++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			for {
+				c, err := s.ClaimCallback(owner, 100, 200)
+				if err != nil {
+					errs <- fmt.Errorf("ClaimCallback(%q): %v", owner, err)
+					return
+				}
+				if c == nil {
+					return
+				}
+				mu.Lock()
+				if other, ok := claimed[c.Id]; ok {
+					errs <- fmt.Errorf("callback %d is claimed by %q and %q", c.Id, other, owner)
+				}
+				claimed[c.Id] = owner
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("notifier-%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(claimed) != callbacks {
+		t.Fatalf("claimed %d callbacks; want %d", len(claimed), callbacks)
+	}
+}
+
+func testMediaStreams(t *testing.T, s storage.Storager) {
+	hd := mustInsertFile(t, s, "http://host/hd.mp4", "hash")
+	sd := mustInsertFile(t, s, "http://host/sd.mp4", "hash")
+
+	streams := []storage.MediaStreamModel{
+		{FileId: hd, Index: 0, CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, BitRate: 5000000, Duration: 10.5},
+		{FileId: hd, Index: 1, CodecType: "audio", CodecName: "aac", BitRate: 128000, Duration: 10.5, Language: "eng"},
+	}
+	// Streams are replaced, so inserting them twice mustn't duplicate them.
+	for i := 0; i < 2; i++ {
+		if err := s.InsertMediaStreams(hd, streams); err != nil {
+			t.Fatalf("InsertMediaStreams(): %v", err)
+		}
+	}
+	err := s.InsertMediaStreams(sd, []storage.MediaStreamModel{
+		{FileId: sd, Index: 0, CodecType: "video", CodecName: "h264", Width: 640, Height: 360, BitRate: 800000},
+	})
+	if err != nil {
+		t.Fatalf("InsertMediaStreams(): %v", err)
+	}
+
+	got, err := s.SelectMediaStreams(hd)
+	if err != nil {
+		t.Fatalf("SelectMediaStreams(): %v", err)
+	}
+	if len(got) != len(streams) {
+		t.Fatalf("SelectMediaStreams() returned %d streams; want %d", len(got), len(streams))
+	}
+	for i := range streams {
+		if got[i] != streams[i] {
+			t.Fatalf("SelectMediaStreams()[%d] = %+v; want %+v", i, got[i], streams[i])
+		}
+	}
+
+	filters := []struct {
+		filter storage.MediaStreamFilter
+		want   []int
+	}{
+		{storage.MediaStreamFilter{}, []int{hd, sd}},
+		{storage.MediaStreamFilter{CodecType: "video", CodecName: "h264", Height: 1080}, []int{hd}},
+		{storage.MediaStreamFilter{CodecName: "h264", MinBitRate: 1000000}, []int{hd}},
+		{storage.MediaStreamFilter{Language: "eng"}, []int{hd}},
+		{storage.MediaStreamFilter{Width: 640}, []int{sd}},
+		{storage.MediaStreamFilter{CodecName: "vp9"}, []int{}},
+	}
+	for _, f := range filters {
+		files, err := s.SelectFilesByMediaStream(&f.filter)
+		if err != nil {
+			t.Fatalf("SelectFilesByMediaStream(%+v): %v", f.filter, err)
+		}
+		ids := make([]int, 0, len(files))
+		for _, file := range files {
+			ids = append(ids, file.Id)
+		}
+		if !equalIds(ids, f.want) {
+			t.Errorf("SelectFilesByMediaStream(%+v) = %v; want %v", f.filter, ids, f.want)
+		}
+	}
+}
+
+func equalIds(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}